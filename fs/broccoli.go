@@ -2,11 +2,15 @@
 package fs
 
 import (
+	"crypto/cipher"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Broccoli is a virtual file system of brotli-compressed assets.
@@ -20,42 +24,113 @@ type Broccoli struct {
 	files     map[string]*File
 	filePaths []string
 
-	devMode bool
+	devMode   bool
+	observer  Observer
+	cache     cache
+	ready     chan struct{} // closed once loaded
+	verify    VerifyPolicy
+	sum       []byte // bundle checksum
+	version   int    // bundle format version
+	untrusted bool   // loaded with Load, see decompress
+
+	encrypted bool
+	keyCheck  []byte
+	key       KeyProvider
+	keyMu     sync.Mutex
+	aead      cipher.AEAD
+
+	overlay *overlay // files written at runtime
+
+	fold     bool              // case-insensitive lookups
+	folded   map[string]string // lowercase paths, see CaseInsensitive
+	foldOnce sync.Once
+
+	lazy   func() // deferred initialization
+	once   sync.Once
+	failed interface{} // the panic of lazy, if any
+
+	parent *Broccoli // of the sub-tree view, see Sub
+	dir    string
+
+	live      atomic.Value // *Broccoli, the replacement, if any
+	replaceMu sync.Mutex
+	onReplace []func()
+}
+
+// init performs the deferred initialization, if any, and
+// returns the current version of br, see Replace and Sub.
+func (br *Broccoli) init() *Broccoli {
+	if br.parent != nil {
+		return br.parent.init()
+	}
+	if br.lazy != nil {
+		br.once.Do(func() {
+			defer func() { br.failed = recover() }()
+			br.lazy()
+		})
+		// Every use fails, rather than sees no files.
+		if br.failed != nil {
+			panic(br.failed)
+		}
+	}
+	if next, ok := br.live.Load().(*Broccoli); ok {
+		return next
+	}
+	return br
 }
 
 // Open opens the named file for reading. If successful, methods on
 // the returned file can be used for reading.
 func (br *Broccoli) Open(path string) (http.File, error) {
-	path = normalize(path)
-
-	if br.devMode {
-		return os.Open(path)
+	br, path, err := br.within("open", path)
+	if err != nil {
+		return nil, err
 	}
 
-	if f, ok := br.files[path]; ok {
-		if err := f.Open(); err != nil {
+	if br.devMode {
+		f, err := os.Open(local(path))
+		if br.observer != nil {
+			br.observer.Open(path, err == nil)
+		}
+		if err != nil {
 			return nil, err
 		}
 		return f, nil
 	}
 
-	return nil, os.ErrNotExist
+	br = br.init()
+
+	f, ok := br.lookup(path)
+	if br.observer != nil {
+		br.observer.Open(path, ok)
+	}
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	h, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	// The written files outlive the versions, see Replace.
+	h.br = br
+	return h, nil
 }
 
 // Stat returns a FileInfo describing the named file.
 func (br *Broccoli) Stat(path string) (os.FileInfo, error) {
-	path = normalize(path)
+	br, path, err := br.within("stat", path)
+	if err != nil {
+		return nil, err
+	}
 
 	if br.devMode {
-		f, err := os.Open(path)
-		if err != nil {
-			return nil, err
-		}
-
-		return f.Stat()
+		return os.Stat(local(path))
 	}
 
-	if f, ok := br.files[path]; ok {
+	br = br.init()
+
+	if f, ok := br.lookup(path); ok {
 		return f, nil
 	}
 
@@ -69,15 +144,40 @@ func (br *Broccoli) Stat(path string) (os.FileInfo, error) {
 // large directories Walk can be inefficient.
 // Walk does not follow symbolic links.
 func (br *Broccoli) Walk(root string, walkFn filepath.WalkFunc) error {
-	root = normalize(root)
+	view := br
+	br, root, err := br.within("walk", root)
+	if err != nil {
+		return err
+	}
+	if view.parent != nil {
+		fn := walkFn
+		walkFn = func(path string, info os.FileInfo, err error) error {
+			return fn(view.rel(path), info, err)
+		}
+	}
 
 	if br.devMode {
-		return filepath.Walk(root, walkFn)
+		return filepath.Walk(local(root), walkFn)
 	}
 
-	pos := sort.SearchStrings(br.filePaths, root)
-	for ; pos < len(br.filePaths) && strings.HasPrefix(br.filePaths[pos], root); pos++ {
-		f := br.files[br.filePaths[pos]]
+	br = br.init()
+
+	f, ok := br.lookup(root)
+	if !ok {
+		return nil
+	}
+	root = f.Fpath
+	if err := walkFn(f.Fpath, f, nil); err != nil {
+		return err
+	}
+
+	paths, prefix := br.paths(), dirPrefix(root)
+	pos := sort.SearchStrings(paths, prefix)
+	for ; pos < len(paths) && strings.HasPrefix(paths[pos], prefix); pos++ {
+		f, ok := br.lookup(paths[pos])
+		if !ok || f.Fpath == root {
+			continue
+		}
 		err := walkFn(f.Fpath, f, nil)
 		if err != nil {
 			return err
@@ -87,6 +187,44 @@ func (br *Broccoli) Walk(root string, walkFn filepath.WalkFunc) error {
 	return nil
 }
 
+// children returns the direct entries of the directory, sorted by name.
+func (br *Broccoli) children(dir string) []*File {
+	var (
+		files  []*File
+		paths  = br.paths()
+		prefix = dirPrefix(dir)
+	)
+	pos := sort.SearchStrings(paths, prefix)
+	for ; pos < len(paths) && strings.HasPrefix(paths[pos], prefix); pos++ {
+		name := paths[pos][len(prefix):]
+		if name == "." || strings.Contains(name, "/") {
+			continue
+		}
+		if f, ok := br.lookup(paths[pos]); ok {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// dirPrefix returns the common prefix of the paths within the directory.
+func dirPrefix(dir string) string {
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// Ready returns a channel, which is closed once all the files to be
+// decompressed at startup have been decompressed, see NewAsync.
+//
+// 	<-br.Ready()
+//
+func (br *Broccoli) Ready() <-chan struct{} {
+	br = br.init()
+	return br.ready
+}
+
 // Development controls the development mode.
 //
 // If enabled, broccoli will use the local file system instead of
@@ -99,20 +237,30 @@ func (br *Broccoli) Walk(root string, walkFn filepath.WalkFunc) error {
 // 	}
 //
 func (br *Broccoli) Development(mode bool) {
-	br.devMode = mode
+	br.base().devMode = mode
 }
 
-func normalize(path string) string {
-	if strings.HasPrefix(path, "./") {
-		return path[2:]
-	}
+// clean resolves the name to the canonical path of the file, which
+// is slash-separated and relative to the root of the bundle, "." for
+// the root itself. Either slashes or backslashes separate the elements.
+//
+// The names escaping the root, such as "../secret", or the local
+// volume, such as "C:/secret" on Windows, are rejected with
+// os.ErrInvalid, both in the bundle and in the development mode.
+func clean(op, name string) (string, error) {
+	cleaned := strings.ReplaceAll(name, `\`, "/")
+	cleaned = path.Clean(strings.TrimLeft(cleaned, "/"))
 
-	if strings.HasPrefix(path, "/") {
-		return path[1:]
-	}
-	if strings.HasSuffix(path, "/") {
-		return path[:len(path)-1]
+	switch {
+	case cleaned == ".." || strings.HasPrefix(cleaned, "../"),
+		strings.IndexByte(cleaned, 0) >= 0,
+		filepath.VolumeName(local(cleaned)) != "":
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
 	}
+	return cleaned, nil
+}
 
-	return path
+// local returns the local path of the cleaned name.
+func local(name string) string {
+	return filepath.FromSlash(name)
 }
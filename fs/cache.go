@@ -0,0 +1,233 @@
+package fs
+
+import (
+	"container/list"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CacheStats describes the state of the lazily decompressed files cache.
+type CacheStats struct {
+	Hits      uint64 // opens of already decompressed files
+	Misses    uint64 // opens that required decompression
+	Evictions uint64 // files evicted back to the compressed form
+
+	Size  int64 // decompressed bytes held
+	Limit int64 // memory budget, 0 if unlimited
+}
+
+// cache keeps track of the lazily decompressed files, so that the
+// least recently used of them could be evicted back to the compressed
+// form once the memory budget is exceeded.
+type cache struct {
+	mu    sync.Mutex
+	lru   *list.List // of *File, most recently used first
+	stats CacheStats
+}
+
+// SetCacheLimit sets the memory budget for the files decompressed
+// on the first read, in bytes; 0 stands for no limit, the default.
+//
+// Once the limit is exceeded, the least recently used files are
+// evicted back to the compressed form, the pinned files excluded.
+// It has no effect on the files decompressed eagerly.
+//
+// 	br.SetCacheLimit(64 << 20)
+//
+func (br *Broccoli) SetCacheLimit(limit int64) {
+	br = br.init()
+
+	c := &br.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Limit = limit
+	c.evict()
+}
+
+// Pin decompresses the named files, if necessary, and keeps them
+// resident regardless of the cache limit.
+func (br *Broccoli) Pin(paths ...string) error {
+	view := br
+	br = br.init()
+
+	for _, path := range paths {
+		_, name, err := view.within("pin", path)
+		if err != nil {
+			return err
+		}
+		f, ok := br.bundled(name)
+		if !ok {
+			return errors.Wrap(os.ErrNotExist, path)
+		}
+
+		br.cache.mu.Lock()
+		f.pinned = true
+		if f.elem != nil {
+			br.cache.lru.Remove(f.elem)
+			f.elem = nil
+		}
+		br.cache.mu.Unlock()
+
+		if _, err := br.load(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unpin makes the named files subject to eviction again.
+func (br *Broccoli) Unpin(paths ...string) {
+	view := br
+	br = br.init()
+
+	c := &br.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, path := range paths {
+		_, name, _ := view.within("unpin", path)
+		f, ok := br.bundled(name)
+		if !ok || !f.pinned {
+			continue
+		}
+
+		f.pinned = false
+		if f.raw != nil {
+			f.elem = c.lru.PushFront(f)
+		}
+	}
+	c.evict()
+}
+
+// Preload decompresses the files matching any of the patterns
+// concurrently, in the path.Match syntax against the full path,
+// relative to the view, if br is one, see Sub:
+//
+// 	if err := br.Preload("public/*.html", "public/css/*"); err != nil {
+// 		log.Fatal(err)
+// 	}
+//
+// The preloaded files are subject to the cache limit, unless pinned.
+func (br *Broccoli) Preload(patterns ...string) error {
+	resolved := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		_, name, err := br.within("preload", pattern)
+		if err != nil {
+			return err
+		}
+		resolved[i] = name
+	}
+	br = br.init()
+
+	var files []*File
+	for _, fpath := range br.filePaths {
+		for _, pattern := range resolved {
+			match, err := path.Match(pattern, fpath)
+			if err != nil {
+				return errors.Wrap(err, pattern)
+			}
+
+			if match {
+				files = append(files, br.files[fpath])
+				break
+			}
+		}
+	}
+
+	return parallel(files, func(f *File) error {
+		_, err := br.load(f)
+		return errors.Wrap(err, f.Fpath)
+	})
+}
+
+// CacheStats returns the cache counters.
+func (br *Broccoli) CacheStats() CacheStats {
+	br = br.init()
+	br.cache.mu.Lock()
+	defer br.cache.mu.Unlock()
+	return br.cache.stats
+}
+
+// load returns the decompressed contents of the bundled file,
+// decompressing and caching it if necessary. Concurrent loads of
+// the same file wait for a single decompression.
+func (br *Broccoli) load(f *File) ([]byte, error) {
+	if f.IsDir() {
+		return nil, nil
+	}
+
+	c := &br.cache
+	c.mu.Lock()
+	for f.loading != nil {
+		ch := f.loading
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+	}
+
+	if !f.compressed {
+		if !f.eager {
+			c.stats.Hits++
+		}
+		if f.elem != nil {
+			c.lru.MoveToFront(f.elem)
+		}
+		data := f.Data
+		c.mu.Unlock()
+		return data, nil
+	}
+	if !f.eager {
+		c.stats.Misses++
+	}
+	ch := make(chan struct{})
+	f.loading = ch
+	raw := f.Data
+	c.mu.Unlock()
+
+	data, err := br.unpack(f, raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.loading = nil
+	close(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Data, f.compressed = data, false
+	if f.eager {
+		return data, nil
+	}
+
+	f.raw = raw
+	c.stats.Size += int64(len(data))
+	if !f.pinned {
+		f.elem = c.lru.PushFront(f)
+	}
+	c.evict()
+	return data, nil
+}
+
+// evict brings the least recently used files back to the compressed
+// form until the cache fits the limit. It must be called with the
+// lock held.
+func (c *cache) evict() {
+	for c.stats.Limit > 0 && c.stats.Size > c.stats.Limit {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+
+		f := c.lru.Remove(e).(*File)
+		c.stats.Size -= int64(len(f.Data))
+		c.stats.Evictions++
+
+		f.Data, f.raw, f.compressed = f.raw, nil, true
+		f.elem = nil
+	}
+}
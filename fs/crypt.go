@@ -0,0 +1,152 @@
+package fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNoKey is returned when the bundle is encrypted,
+	// but no key has been provided.
+	ErrNoKey = errors.New("bundle is encrypted, no key provided")
+	// ErrWrongKey is returned when the bundle is encrypted
+	// with a different key.
+	ErrWrongKey = errors.New("wrong bundle key")
+)
+
+// keyCheck is sealed in the bundle to tell the wrong keys apart
+// from the corrupted files.
+var keyCheck = []byte("broccoli")
+
+// KeyProvider supplies the key to decrypt the bundle with, it's
+// called once, when the first encrypted file is opened.
+type KeyProvider func() ([]byte, error)
+
+// KeyFromEnv reads the hex-encoded key from the environment variable.
+func KeyFromEnv(name string) KeyProvider {
+	return func() ([]byte, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, errors.Errorf("environment variable %s is not set", name)
+		}
+		return ParseKey(v)
+	}
+}
+
+// KeyFromFile reads the hex-encoded key from the file.
+func KeyFromFile(path string) KeyProvider {
+	return func() ([]byte, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKey(string(data))
+	}
+}
+
+// ParseKey decodes the hex-encoded AES key, 16, 24 or 32 bytes long.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed key")
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, errors.Errorf("bad key length %d, must be 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// NewWithKey is like New for the bundles encrypted by broccoli the
+// tool with the -encrypt option. The files are decrypted and then
+// decompressed on Open, which fails with ErrWrongKey if the key
+// doesn't match the bundle.
+//
+// This function is only supposed to be called from the generated code.
+func NewWithKey(bundle []byte, key KeyProvider) *Broccoli {
+	v := &Broccoli{key: key}
+	if err := v.build(true, bundle); err != nil {
+		panic(err)
+	}
+	return versioned(v)
+}
+
+// cipher returns the AEAD of the bundle, supplying the key if necessary.
+func (br *Broccoli) cipher() (cipher.AEAD, error) {
+	br.keyMu.Lock()
+	defer br.keyMu.Unlock()
+
+	if br.aead != nil {
+		return br.aead, nil
+	}
+	if br.key == nil {
+		return nil, ErrNoKey
+	}
+
+	key, err := br.key()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not supply the key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unseal(aead, br.keyCheck, keyCheck); err != nil {
+		return nil, ErrWrongKey
+	}
+
+	br.aead = aead
+	return aead, nil
+}
+
+// unpack decrypts, if necessary, and decompresses the file data.
+func (br *Broccoli) unpack(f *File, data []byte) ([]byte, error) {
+	if br.encrypted {
+		aead, err := br.cipher()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = unseal(aead, data, []byte(f.Fpath))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decrypt")
+		}
+	}
+
+	return f.decompress(data)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates the data, prepending the random nonce.
+func seal(aead cipher.AEAD, data, extra []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, extra), nil
+}
+
+// unseal authenticates and decrypts the data sealed by seal.
+func unseal(aead cipher.AEAD, data, extra []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:n], data[n:], extra)
+}
@@ -0,0 +1,81 @@
+package fs
+
+import "github.com/pkg/errors"
+
+// deltaBlock is the shortest match the delta looks for.
+const deltaBlock = 32
+
+// deltaOp either copies Len bytes at Off from the base,
+// or inserts Data, if any.
+type deltaOp struct {
+	Off, Len int64
+	Data     []byte
+}
+
+// delta computes the operations turning base into target,
+// copying the blocks shared with base and inserting the rest.
+func delta(base, target []byte) []deltaOp {
+	blocks := make(map[string]int, len(base)/deltaBlock)
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		if _, ok := blocks[string(base[i:i+deltaBlock])]; !ok {
+			blocks[string(base[i:i+deltaBlock])] = i
+		}
+	}
+
+	var (
+		ops     []deltaOp
+		literal int // start of the pending insertion
+	)
+	for i := 0; i+deltaBlock <= len(target); {
+		off, ok := blocks[string(target[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
+
+		// Extend the match both ways.
+		start, end := i, i+deltaBlock
+		for start > literal && off > 0 && target[start-1] == base[off-1] {
+			start--
+			off--
+		}
+		for n := off + end - start; end < len(target) && n < len(base) && target[end] == base[n]; n++ {
+			end++
+		}
+
+		if start > literal {
+			ops = append(ops, deltaOp{Data: target[literal:start]})
+		}
+		ops = append(ops, deltaOp{Off: int64(off), Len: int64(end - start)})
+		i, literal = end, end
+	}
+
+	if literal < len(target) {
+		ops = append(ops, deltaOp{Data: target[literal:]})
+	}
+	return ops
+}
+
+// applyDelta reconstructs the target of the given size from base.
+func applyDelta(base []byte, ops []deltaOp, size int64) ([]byte, error) {
+	var b []byte
+	for _, op := range ops {
+		chunk := op.Data
+		if chunk == nil {
+			if op.Off < 0 || op.Len < 0 || op.Off > int64(len(base))-op.Len {
+				return nil, errors.Wrap(ErrCorrupt, "copy out of range")
+			}
+			chunk = base[op.Off : op.Off+op.Len]
+		}
+
+		if int64(len(chunk)) > size-int64(len(b)) {
+			return nil, errors.Wrap(ErrCorrupt, "size limit exceeded")
+		}
+		b = append(b, chunk...)
+	}
+
+	if int64(len(b)) != size {
+		return nil, errors.Wrap(ErrCorrupt, "size mismatch")
+	}
+	return b, nil
+}
@@ -2,12 +2,12 @@ package fs
 
 import (
 	"bytes"
+	"container/list"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
 	"time"
 
@@ -15,12 +15,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-var root string
-
-func init() {
-	root, _ = os.Getwd()
-}
-
 // File represents a bundled asset.
 //
 // It should never be created explicitly, but rather accessed
@@ -34,10 +28,24 @@ type File struct {
 	Fname string
 	Fsize int64
 	Ftime int64
+	Fhash []byte // SHA-256 of the contents
+	Fsri  string // Subresource Integrity digest
+
+	// Eager files are decompressed while loading the bundle,
+	// even if optional decompression is enabled.
+	Eager bool
 
 	buffer *bytes.Buffer
 	br     *Broccoli
 	rdi    int // read dir index
+
+	raw       []byte        // compressed data of a cached file
+	elem      *list.Element // position in the cache
+	pinned    bool
+	eager     bool          // decompressed at startup, never cached
+	loading   chan struct{} // closed once decompressed
+	verified  bool
+	synthetic bool // missing parent directory
 }
 
 // Stat returns a FileInfo describing this file.
@@ -45,7 +53,8 @@ func (f *File) Stat() (os.FileInfo, error) {
 	return f.br.Stat(f.Fpath)
 }
 
-// NewFile constructs a new bundled file from the disk.
+// NewFile constructs a new bundled file from the disk, its path
+// is relative to the working directory, see PackFS otherwise.
 //
 // It is only supposed to be called from the broccoli tool.
 func NewFile(path string) (*File, error) {
@@ -59,6 +68,7 @@ func NewFile(path string) (*File, error) {
 		return nil, err
 	}
 
+	root, _ := os.Getwd()
 	path, _ = filepath.Abs(path)
 	path, _ = filepath.Rel(root, path)
 
@@ -66,13 +76,9 @@ func NewFile(path string) (*File, error) {
 	if runtime.GOOS == "windows" {
 		path = strings.ReplaceAll(path, `\`, "/")
 	}
-	if strings.HasPrefix(path, "../") {
-		path = strings.TrimLeft(path, "../")
-	}
-
-	time := fileInfo.ModTime().Unix()
-	if fileInfo.IsDir() {
-		time = -time
+	// TrimLeft would eat the dots of the dotfiles, too.
+	for strings.HasPrefix(path, "../") {
+		path = strings.TrimPrefix(path, "../")
 	}
 
 	return &File{
@@ -80,24 +86,72 @@ func NewFile(path string) (*File, error) {
 		Fpath: path,
 		Fname: fileInfo.Name(),
 		Fsize: fileInfo.Size(),
-		Ftime: time,
+		Ftime: modTime(fileInfo),
 	}, nil
 }
 
+// modTime returns the Ftime of the file, negated for directories,
+// which are at least a second past the epoch to tell them apart.
+func modTime(info os.FileInfo) int64 {
+	t := info.ModTime().Unix()
+	if !info.IsDir() {
+		if t < 0 {
+			return 0
+		}
+		return t
+	}
+
+	if t < 1 {
+		t = 1
+	}
+	return -t
+}
+
 // Open opens the file for reading. If successful, methods on
 // the returned file can be used for reading.
 func (f *File) Open() error {
+	data := f.Data
 	if f.compressed {
-		if err := f.decompress(f.Data); err != nil {
+		var err error
+		if f.br != nil {
+			data, err = f.br.load(f)
+		} else {
+			data, err = f.decompress(f.Data)
+			f.Data, f.compressed = data, false
+		}
+		if err != nil {
 			return errors.Wrap(err, "could not decompress")
 		}
 	}
 
-	f.buffer = bytes.NewBuffer(f.Data)
+	f.buffer = bytes.NewBuffer(data)
 	f.rdi = 0
 	return nil
 }
 
+// open returns a new handle of the bundled file for reading, so that
+// concurrent readers and cache evictions don't interfere.
+func (f *File) open() (*File, error) {
+	data, err := f.br.load(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decompress")
+	}
+	if err := f.br.check(f, data); err != nil {
+		return nil, err
+	}
+
+	h := &File{
+		Data:  data,
+		Fpath: f.Fpath,
+		Fname: f.Fname,
+		Fsize: f.Fsize,
+		Ftime: f.Ftime,
+		br:    f.br,
+	}
+	h.buffer = bytes.NewBuffer(data)
+	return h, nil
+}
+
 // Read reads the next len(p) bytes from the buffer or until the buffer
 // is drained. The return value n is the number of bytes read. If the
 // buffer has no data to return, err is io.EOF (unless len(p) is zero);
@@ -118,6 +172,7 @@ var (
 // Seek sets the offset for the next Read or Write on file to offset,
 // interpreted according to whence: 0 means relative to the origin of the file,
 // 1 means relative to the current offset, and 2 means relative to the end.
+// The offsets past the end of the file are rejected, as those before the origin.
 //
 // It returns the new offset and and error, if any.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
@@ -127,37 +182,29 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 
 	n := int64(len(f.Data))
 
+	var i int64
 	switch whence {
 	// io.SeekStart
 	// seek relative to the origin of the file
 	case 0:
-		if offset >= n {
-			return 0, errBadOffset
-		}
-		f.buffer = bytes.NewBuffer(f.Data[offset:])
-		return offset, nil
+		i = offset
 	// io.SeekCurrent
 	// seek relative to the current offset
 	case 1:
-		if offset >= int64(f.buffer.Len()) {
-			return 0, errBadOffset
-		}
-		i := n - int64(f.buffer.Len()) + offset
-		f.buffer = bytes.NewBuffer(f.Data[i:])
-		return i, nil
+		i = n - int64(f.buffer.Len()) + offset
 	// io.SeekEnd
 	// seek relative to the end
 	case 2:
-		if offset >= n {
-			return 0, errBadOffset
-		}
-
-		i := n - offset
-		f.buffer = bytes.NewBuffer(f.Data[i:])
-		return i, nil
+		i = n + offset
 	default:
 		return 0, errBadWhence
 	}
+
+	if i < 0 || i > n {
+		return 0, errBadOffset
+	}
+	f.buffer = bytes.NewBuffer(f.Data[i:])
+	return i, nil
 }
 
 // Close clears the dedicated file buffer.
@@ -225,45 +272,29 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, os.ErrInvalid
 	}
 
-	if f.rdi < 0 {
-		return nil, io.ErrUnexpectedEOF
-	}
-
-	br := f.br
-	if count < 0 {
-		count = 0
+	children := f.br.children(f.Fpath)
+	if f.rdi > len(children) {
+		f.rdi = len(children)
 	}
 
-	files := make([]os.FileInfo, 0, count)
-	firstId := sort.SearchStrings(br.filePaths, f.Fpath) + 1
-
-	var eof error
-	for i := firstId + f.rdi; i < len(br.files); i++ {
-		g := br.files[br.filePaths[i]]
-		if !strings.HasPrefix(g.Fpath, f.Fpath) {
-			eof = io.EOF
-			break
+	rest := children[f.rdi:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return []os.FileInfo{}, io.EOF
 		}
-
-		files = append(files, g)
-		f.rdi++
-
-		if count != 0 && len(files) == count {
-			break
+		if len(rest) > count {
+			rest = rest[:count]
 		}
-	}
-
-	if eof == io.EOF || firstId+f.rdi == len(br.files) {
+		f.rdi += len(rest)
+	} else {
 		f.rdi = 0
-
-		if count == 0 {
-			eof = nil
-		} else {
-			f.rdi = -1
-		}
 	}
 
-	return files, eof
+	files := make([]os.FileInfo, len(rest))
+	for i, g := range rest {
+		files[i] = g
+	}
+	return files, nil
 }
 
 // Sys is a mystery and always returns nil.
@@ -286,14 +317,32 @@ func (f *File) compress(quality int) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func (f *File) decompress(data []byte) error {
-	r := brotli.NewReader(bytes.NewReader(data))
-	b, err := ioutil.ReadAll(r)
+func (f *File) decompress(data []byte) (b []byte, err error) {
+	start := time.Now()
+	err = safely(func() error {
+		var r io.Reader = brotli.NewReader(bytes.NewReader(data))
+		// The size is trusted since the format version 1, and
+		// always enforced for the bundles from Load.
+		limited := f.br != nil && (f.br.version > 0 || f.br.untrusted)
+		if limited {
+			r = &limitReader{r, f.Fsize}
+		}
+
+		if b, err = ioutil.ReadAll(r); err != nil {
+			return corrupt(err)
+		}
+		if limited && int64(len(b)) != f.Fsize {
+			return corrupt(errors.New("size mismatch"))
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	f.Data = b
-	f.compressed = false
-	return nil
+	if f.br != nil && f.br.observer != nil {
+		f.br.observer.Decompress(f.Fpath, time.Since(start), len(data), len(b))
+	}
+
+	return b, nil
 }
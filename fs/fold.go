@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CaseInsensitive controls the case-insensitive lookup mode, in which
+// the files are found regardless of the case of the names, such that
+// "Logo.PNG" opens "logo.png", when there's no exact match.
+//
+// The mode is also enabled by the bundles packed with the option,
+// see PackOptions. Should the paths only differ in case, the first
+// of them in lexical order wins. The Servers match their rules and
+// prefixes regardless of case as well. In the development mode, the
+// local file system is used as is.
+//
+// 	br.CaseInsensitive(true)
+//
+func (br *Broccoli) CaseInsensitive(mode bool) {
+	br = br.base()
+	br.fold = mode
+	if next, ok := br.live.Load().(*Broccoli); ok {
+		next.fold = mode
+	}
+}
+
+// bundled returns the named bundled file, matched case-insensitively
+// in the case-insensitive mode, when there's no exact match.
+func (br *Broccoli) bundled(name string) (*File, bool) {
+	f, ok := br.files[name]
+	if ok || !br.fold {
+		return f, ok
+	}
+
+	br.foldOnce.Do(func() {
+		br.folded = make(map[string]string, len(br.filePaths))
+		for _, fpath := range br.filePaths {
+			key := strings.ToLower(fpath)
+			if _, ok := br.folded[key]; !ok {
+				br.folded[key] = fpath
+			}
+		}
+	})
+
+	fpath, ok := br.folded[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	return br.files[fpath], true
+}
+
+// foldCollisions returns an error listing the paths, the parent
+// directories included, which only differ in case, if any.
+func foldCollisions(paths []string) error {
+	all := map[string]bool{}
+	for _, fpath := range paths {
+		for ; fpath != "." && fpath != "/" && !all[fpath]; fpath = path.Dir(fpath) {
+			all[fpath] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(all))
+	for fpath := range all {
+		sorted = append(sorted, fpath)
+	}
+	sort.Strings(sorted)
+
+	var (
+		seen       = make(map[string]string, len(sorted))
+		collisions []string
+	)
+	for _, fpath := range sorted {
+		key := strings.ToLower(fpath)
+		if prev, ok := seen[key]; ok {
+			collisions = append(collisions, prev+" and "+fpath)
+			continue
+		}
+		seen[key] = fpath
+	}
+
+	if collisions != nil {
+		return errors.Errorf("paths differ only in case: %s",
+			strings.Join(collisions, ", "))
+	}
+	return nil
+}
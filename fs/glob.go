@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Glob returns the sorted paths of the files matching the pattern,
+// in the path.Match syntax, extended with ** matching any number of
+// the path elements, and {a,b} matching either of the alternatives:
+//
+// 	templates, err := br.Glob("templates/**/*.{tmpl,html}")
+//
+// Only the files under the longest literal prefix of the pattern, such
+// as "templates" above, are matched. The paths are relative to the
+// view, if br is one, see Sub. The only possible returned error is
+// path.ErrBadPattern, when the pattern is malformed.
+func (br *Broccoli) Glob(pattern string) ([]string, error) {
+	patterns, err := expandBraces(strings.TrimLeft(pattern, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		elems := strings.Split(pattern, "/")
+		for _, elem := range elems {
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, name := range br.globCandidates(elems) {
+			if !seen[name] && name != "." && matchElems(elems, strings.Split(name, "/")) {
+				seen[name] = true
+			}
+		}
+	}
+
+	matches := make([]string, 0, len(seen))
+	for name := range seen {
+		matches = append(matches, name)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// globCandidates returns the paths, relative to the view, of the
+// files under the literal prefix of the pattern elements.
+func (br *Broccoli) globCandidates(elems []string) []string {
+	n := 0
+	for n < len(elems)-1 && !hasMeta(elems[n]) {
+		n++
+	}
+
+	_, dir, err := br.within("glob", path.Join(elems[:n]...))
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	if br.base().devMode {
+		filepath.Walk(local(dir), func(name string, _ os.FileInfo, err error) error {
+			if err == nil {
+				names = append(names, filepath.ToSlash(br.rel(name)))
+			}
+			return nil
+		})
+		return names
+	}
+
+	base := br.init()
+	if _, ok := base.lookup(dir); ok {
+		names = append(names, br.rel(dir))
+	}
+
+	paths, prefix := base.paths(), dirPrefix(dir)
+	pos := sort.SearchStrings(paths, prefix)
+	for ; pos < len(paths) && strings.HasPrefix(paths[pos], prefix); pos++ {
+		names = append(names, br.rel(paths[pos]))
+	}
+	return names
+}
+
+// matchElems matches the path elements against the pattern ones.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// expandBraces expands the {a,b} alternatives of the pattern.
+func expandBraces(pattern string) ([]string, error) {
+	var (
+		depth, start int
+		commas       []int
+	)
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start, commas = i, nil
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			if depth--; depth > 0 {
+				continue
+			}
+
+			var expanded []string
+			from := start
+			for _, to := range append(commas, i) {
+				alt := pattern[:start] + pattern[from+1:to] + pattern[i+1:]
+				more, err := expandBraces(alt)
+				if err != nil {
+					return nil, err
+				}
+				expanded = append(expanded, more...)
+				from = to
+			}
+			return expanded, nil
+		}
+	}
+
+	if depth > 0 {
+		return nil, path.ErrBadPattern
+	}
+	return []string{pattern}, nil
+}
+
+func hasMeta(elem string) bool {
+	return strings.ContainsAny(elem, `*?[\`)
+}
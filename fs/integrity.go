@@ -0,0 +1,138 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VerifyPolicy controls when the contents of the bundled files are
+// checked against the checksums stored in the bundle.
+type VerifyPolicy int
+
+const (
+	// VerifyNever disables the verification, the default.
+	VerifyNever VerifyPolicy = iota
+	// VerifyOnce verifies the file the first time it's opened.
+	VerifyOnce
+	// VerifyAlways verifies the file every time it's opened.
+	VerifyAlways
+)
+
+// IntegrityError is returned when the contents of the bundle
+// don't match the stored checksums.
+type IntegrityError struct {
+	Paths  []string // mismatched files
+	Bundle bool     // whether if the bundle checksum mismatched
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Bundle {
+		return "bundle checksum mismatch"
+	}
+	return "checksum mismatch: " + strings.Join(e.Paths, ", ")
+}
+
+// SetVerify sets the verification policy for Open.
+//
+// 	br.SetVerify(fs.VerifyOnce)
+//
+func (br *Broccoli) SetVerify(policy VerifyPolicy) {
+	br = br.init()
+
+	br.cache.mu.Lock()
+	br.verify = policy
+	br.cache.mu.Unlock()
+}
+
+// Verify decompresses every bundled file and checks it, along with
+// the bundle itself, against the stored checksums. It returns an
+// *IntegrityError listing every mismatched or undecodable path, if any.
+// A view only checks the files within, see Sub.
+//
+// The bundles generated by the older versions of broccoli don't
+// have checksums, in which case the files are only decompressed.
+func (br *Broccoli) Verify() error {
+	view := br
+	br = br.init()
+
+	if br.sum != nil && !bytes.Equal(br.sum, bundleSum(br.filePaths, br.files)) {
+		return &IntegrityError{Bundle: true}
+	}
+
+	var (
+		mu  sync.Mutex
+		bad []string
+	)
+	var files []*File
+	for _, fpath := range br.filePaths {
+		if f := br.files[fpath]; !f.IsDir() && view.contains(fpath) {
+			files = append(files, f)
+		}
+	}
+
+	parallel(files, func(f *File) error {
+		br.cache.mu.Lock()
+		data, compressed := f.Data, f.compressed
+		br.cache.mu.Unlock()
+
+		var err error
+		if compressed {
+			data, err = br.unpack(f, data)
+		}
+		if err != nil || f.Fhash != nil && !bytes.Equal(checksum(data), f.Fhash) {
+			mu.Lock()
+			bad = append(bad, view.rel(f.Fpath))
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return &IntegrityError{Paths: bad}
+	}
+	return nil
+}
+
+// check verifies the decompressed data of the file
+// according to the policy.
+func (br *Broccoli) check(f *File, data []byte) error {
+	br.cache.mu.Lock()
+	policy, verified := br.verify, f.verified
+	br.cache.mu.Unlock()
+
+	if f.Fhash == nil || policy == VerifyNever || policy == VerifyOnce && verified {
+		return nil
+	}
+	if !bytes.Equal(checksum(data), f.Fhash) {
+		return &IntegrityError{Paths: []string{f.Fpath}}
+	}
+
+	br.cache.mu.Lock()
+	f.verified = true
+	br.cache.mu.Unlock()
+	return nil
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// bundleSum is the checksum of the sorted paths and the checksums
+// of the files, the synthesized directories excluded.
+func bundleSum(paths []string, files map[string]*File) []byte {
+	h := sha256.New()
+	for _, fpath := range paths {
+		if files[fpath].synthetic {
+			continue
+		}
+		h.Write([]byte(fpath))
+		h.Write([]byte{0})
+		h.Write(files[fpath].Fhash)
+	}
+	return h.Sum(nil)
+}
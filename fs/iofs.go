@@ -0,0 +1,133 @@
+//go:build go1.16
+// +build go1.16
+
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"strings"
+)
+
+// FS returns the io/fs view of br, it implements fs.StatFS and
+// fs.GlobFS, so fs.Glob, fs.WalkDir and the rest take the shortcuts:
+//
+// 	templates, err := template.ParseFS(br.FS(), "templates/**/*.tmpl")
+//
+func (br *Broccoli) FS() iofs.FS {
+	return ioFS{br}
+}
+
+type ioFS struct {
+	br *Broccoli
+}
+
+func (fsys ioFS) Open(name string) (iofs.File, error) {
+	if !validPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	f, err := fsys.br.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys ioFS) Stat(name string) (iofs.FileInfo, error) {
+	if !validPath(name) {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: iofs.ErrInvalid}
+	}
+	return fsys.br.Stat(name)
+}
+
+func (fsys ioFS) Glob(pattern string) ([]string, error) {
+	return fsys.br.Glob(pattern)
+}
+
+// validPath reports whether the name is valid for io/fs, where
+// the backslashes are not separators, unlike in Open.
+func validPath(name string) bool {
+	return iofs.ValidPath(name) && !strings.Contains(name, `\`)
+}
+
+// ReadDir reads the directory like Readdir, but returns the directory
+// entries and, unlike Readdir, keeps the position for count <= 0, as
+// in fs.ReadDirFile.
+func (f *File) ReadDir(count int) ([]iofs.DirEntry, error) {
+	if !f.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: f.Fpath, Err: errNotDir}
+	}
+
+	children := f.br.children(f.Fpath)
+	if f.rdi > len(children) {
+		f.rdi = len(children)
+	}
+
+	rest := children[f.rdi:]
+	if count > 0 && len(rest) > count {
+		rest = rest[:count]
+	}
+	if count > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	f.rdi += len(rest)
+
+	entries := make([]iofs.DirEntry, len(rest))
+	for i, g := range rest {
+		entries[i] = iofs.FileInfoToDirEntry(g)
+	}
+	return entries, nil
+}
+
+// PackFS packs the files of the file system, such as embed.FS or
+// fstest.MapFS, like PackWith, with the paths relative to its root,
+// or to Root, if set, rather than to the working directory. Below,
+// site/public/index.html is bundled as index.html:
+//
+// 	bundle, err := fs.PackFS(os.DirFS("site"), fs.PackOptions{
+// 		Quality: 11,
+// 		Root:    "public",
+// 	})
+//
+func PackFS(fsys iofs.FS, opts PackOptions) ([]byte, error) {
+	if opts.Root != "" && opts.Root != "." {
+		sub, err := iofs.Sub(fsys, opts.Root)
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+
+	var files []*File
+	err := iofs.WalkDir(fsys, ".", func(name string, d iofs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f := &File{
+			Fpath: name,
+			Fname: info.Name(),
+			Fsize: info.Size(),
+			Ftime: modTime(info),
+		}
+		if !d.IsDir() {
+			if f.Data, err = iofs.ReadFile(fsys, name); err != nil {
+				return err
+			}
+		}
+
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return PackWith(files, opts)
+}
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListingMode controls how the Server renders directories
+// which don't have an index document.
+type ListingMode int
+
+const (
+	// ListingHTML renders a plain HTML list of links,
+	// the same way http.FileServer does.
+	ListingHTML ListingMode = iota
+	// ListingOff disables the listings, directories
+	// without an index document result in 404.
+	ListingOff
+	// ListingJSON renders a JSON array of entries.
+	ListingJSON
+
+	listingTemplate
+)
+
+// DirList is the value ListingTemplate templates are executed with.
+type DirList struct {
+	Path  string
+	Files []os.FileInfo
+}
+
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+var htmlReplacer = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+)
+
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request, name string, f http.File) {
+	all, err := f.Readdir(-1)
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+
+	files := all[:0]
+	for _, info := range all {
+		if !s.hidden(path.Join(name, info.Name())) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	switch s.listing {
+	case ListingJSON:
+		entries := make([]dirEntry, 0, len(files))
+		for _, info := range files {
+			entries = append(entries, dirEntry{
+				Name:    info.Name(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				IsDir:   info.IsDir(),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(entries)
+	case listingTemplate:
+		var b bytes.Buffer
+		if err := s.template.Execute(&b, &DirList{Path: name, Files: files}); err != nil {
+			s.serveError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		b.WriteTo(w)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<pre>\n")
+		for _, info := range files {
+			name := info.Name()
+			if info.IsDir() {
+				name += "/"
+			}
+			// name may contain '?' or '#', which must be escaped to remain
+			// part of the URL path, and not indicate the start of a query
+			// string or fragment.
+			link := url.URL{Path: name}
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), htmlReplacer.Replace(name))
+		}
+		fmt.Fprintf(w, "</pre>\n")
+	}
+}
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrCorrupt is returned when the bundle can't be decoded.
+	ErrCorrupt = errors.New("corrupt bundle")
+	// ErrUnsupportedVersion is returned when the bundle format
+	// is newer than this version of the package supports.
+	ErrUnsupportedVersion = errors.New("unsupported bundle version")
+)
+
+// The bundles start with the magic followed by the format version,
+// the bundles generated by the older versions of broccoli have no
+// header at all, which is version 0.
+const (
+	bundleMagic   = "\x89BRC"
+	bundleVersion = 1
+)
+
+// LoadOptions control how Load decodes the bundle.
+type LoadOptions struct {
+	// Optional enables optional decompression, see New.
+	Optional bool
+	// PublicKey, if set, requires the bundle to be signed
+	// with the corresponding private key, see NewVerified.
+	PublicKey ed25519.PublicKey
+	// Key supplies the key of the encrypted bundle, see NewWithKey.
+	Key KeyProvider
+	// Verify decompresses and checks every file against the
+	// stored checksums before returning, see Broccoli.Verify.
+	Verify bool
+}
+
+// Load decodes the bundle, possibly loaded from an untrusted source,
+// and creates a virtual file system. Unlike New, it never panics,
+// but returns an error instead, which matches ErrCorrupt or
+// ErrUnsupportedVersion with errors.Is, if the bundle is malformed
+// or too new, respectively.
+//
+// The files are never decompressed beyond their recorded sizes,
+// the headerless bundles of the older versions included.
+func Load(bundle []byte, opts LoadOptions) (*Broccoli, error) {
+	if opts.PublicKey != nil {
+		payload, err := verifySignature(bundle, opts.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		bundle = payload
+	}
+
+	v := &Broccoli{key: opts.Key, untrusted: true}
+	if err := v.build(opts.Optional, bundle); err != nil {
+		return nil, err
+	}
+
+	if opts.Verify {
+		if err := v.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return versioned(v), nil
+}
+
+// header returns the format version of the bundle and its payload.
+func header(bundle []byte) (int, []byte, error) {
+	if !bytes.HasPrefix(bundle, []byte(bundleMagic)) {
+		return 0, bundle, nil
+	}
+
+	n := len(bundleMagic)
+	if len(bundle) == n {
+		return 0, nil, errors.Wrap(ErrCorrupt, "truncated header")
+	}
+	if v := int(bundle[n]); v > bundleVersion {
+		return 0, nil, errors.Wrapf(ErrUnsupportedVersion, "version %d", v)
+	}
+	return int(bundle[n]), bundle[n+1:], nil
+}
+
+// checkIndex validates the decoded files, sorted by path, which
+// must have unique canonical paths and sane sizes.
+func checkIndex(files []*File) error {
+	for i, f := range files {
+		switch {
+		case f == nil:
+			return errors.Wrap(ErrCorrupt, "nil file")
+		case f.Fpath == "":
+			return errors.Wrap(ErrCorrupt, "empty path")
+		case !canonical(f.Fpath):
+			return errors.Wrapf(ErrCorrupt, "bad path %q", f.Fpath)
+		case f.Fsize < 0:
+			return errors.Wrapf(ErrCorrupt, "negative size of %s", f.Fpath)
+		case i > 0 && files[i-1].Fpath == f.Fpath:
+			return errors.Wrapf(ErrCorrupt, "duplicate path %s", f.Fpath)
+		}
+	}
+	return nil
+}
+
+// canonical tells whether if the path is the one clean resolves it to,
+// as the other paths could never be looked up.
+func canonical(fpath string) bool {
+	cleaned, err := clean("load", fpath)
+	return err == nil && cleaned == fpath
+}
+
+// limitReader fails once more than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errors.Wrap(ErrCorrupt, "size limit exceeded")
+	}
+	return n, err
+}
+
+// safely recovers from the panics of the decoders on malformed input.
+func safely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Wrapf(ErrCorrupt, "%v", r)
+		}
+	}()
+	return fn()
+}
+
+// corrupt marks the decoding error as ErrCorrupt.
+func corrupt(err error) error {
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	return errors.Wrap(ErrCorrupt, err.Error())
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// Observer receives the notifications about the bundle access, it's
+// called synchronously and must be safe for concurrent use.
+type Observer interface {
+	// Open is called on every Open, hit tells whether if
+	// the file has been found.
+	Open(path string, hit bool)
+	// Decompress is called after the file has been decompressed
+	// from the compressed size in bytes to the decompressed one.
+	Decompress(path string, elapsed time.Duration, compressed, decompressed int)
+	// Response is called after the Server has responded with the
+	// status code and the content encoding, "identity" if none.
+	Response(path string, status int, encoding string)
+}
+
+// Observe sets the observer of the bundle and its Servers.
+//
+// It's only safe to set the observer before the bundle is in use;
+// the files decompressed prior to that are not reported.
+//
+// 	br.Observe(fs.NewExpvarObserver("assets"))
+//
+func (br *Broccoli) Observe(o Observer) {
+	br = br.base()
+	br.observer = o
+	if next, ok := br.live.Load().(*Broccoli); ok {
+		next.observer = o
+	}
+}
+
+// ExpvarObserver is an Observer accumulating the counters in
+// an expvar.Map:
+//
+//     open.hit, open.miss
+//     decompress.count, decompress.ns,
+//     decompress.bytes.in, decompress.bytes.out
+//     response.status.<code>, response.encoding.<encoding>
+//
+type ExpvarObserver struct {
+	*expvar.Map
+}
+
+// NewExpvarObserver creates an ExpvarObserver with the map published
+// under the name. Like expvar.Publish, it panics if the name is taken.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	return &ExpvarObserver{expvar.NewMap(name)}
+}
+
+// Open increments the open.hit or open.miss counter.
+func (o *ExpvarObserver) Open(path string, hit bool) {
+	if hit {
+		o.Add("open.hit", 1)
+	} else {
+		o.Add("open.miss", 1)
+	}
+}
+
+// Decompress increments the decompression counters.
+func (o *ExpvarObserver) Decompress(path string, elapsed time.Duration, compressed, decompressed int) {
+	o.Add("decompress.count", 1)
+	o.Add("decompress.ns", int64(elapsed))
+	o.Add("decompress.bytes.in", int64(compressed))
+	o.Add("decompress.bytes.out", int64(decompressed))
+}
+
+// Response increments the status code and encoding counters.
+func (o *ExpvarObserver) Response(path string, status int, encoding string) {
+	o.Add("response.status."+strconv.Itoa(status), 1)
+	o.Add("response.encoding."+encoding, 1)
+}
@@ -0,0 +1,294 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// overlay holds the files written at runtime on top of the bundle,
+// it's shared by all the versions of the bundle, see Replace.
+type overlay struct {
+	mu      sync.RWMutex
+	files   map[string]*File // written files and directories
+	paths   []string         // sorted paths of the written files
+	removed map[string]bool  // removed bundled files
+}
+
+func newOverlay() *overlay {
+	return &overlay{
+		files:   map[string]*File{},
+		removed: map[string]bool{},
+	}
+}
+
+// WriteFile writes the data to the named file in memory, creating
+// it if necessary, the bundled file of the same name, if any, is
+// shadowed. The parent directory must exist.
+//
+// The files written are visible to Open, Stat, Walk and Readdir, and
+// so the servers, along with the bundled ones, till the process exits.
+// The files already open are not affected. In the development mode,
+// the local file system is used as is.
+//
+// 	br.WriteFile("public/config.js", []byte(config))
+//
+func (br *Broccoli) WriteFile(name string, data []byte) error {
+	_, name, err := br.within("write", name)
+	if err != nil {
+		return err
+	}
+	br = br.init()
+
+	o := br.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	name, err = o.checkParent(br, "write", name)
+	if err != nil {
+		return err
+	}
+	if f, ok := o.find(br, name); ok {
+		if f.IsDir() {
+			return &os.PathError{Op: "write", Path: name, Err: errIsDir}
+		}
+		name = f.Fpath
+	}
+
+	o.put(&File{
+		Data:  append([]byte{}, data...),
+		Fpath: name,
+		Fname: path.Base(name),
+		Fsize: int64(len(data)),
+		Ftime: time.Now().Unix(),
+		br:    br,
+		eager: true, // never cached
+	})
+	return nil
+}
+
+// Create creates or truncates the named file in memory, like
+// WriteFile, the data written is published on Close.
+func (br *Broccoli) Create(name string) (io.WriteCloser, error) {
+	if err := br.WriteFile(name, nil); err != nil {
+		return nil, err
+	}
+	return &overlayWriter{br: br, name: name}, nil
+}
+
+// Mkdir creates the named directory in memory, the parent
+// directory must exist.
+func (br *Broccoli) Mkdir(name string) error {
+	_, name, err := br.within("mkdir", name)
+	if err != nil {
+		return err
+	}
+	br = br.init()
+
+	o := br.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	name, err = o.checkParent(br, "mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.find(br, name); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	o.put(&File{
+		Fpath: name,
+		Fname: path.Base(name),
+		Ftime: -time.Now().Unix(),
+		br:    br,
+	})
+	return nil
+}
+
+// Remove removes the named file or empty directory, either written
+// or bundled, from the view of br; the bundle itself stays intact.
+func (br *Broccoli) Remove(name string) error {
+	_, name, err := br.within("remove", name)
+	if err != nil {
+		return err
+	}
+	br = br.init()
+
+	o := br.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, ok := o.find(br, name)
+	switch {
+	case name == ".":
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+	case !ok:
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	name = f.Fpath
+	if f.IsDir() {
+		for _, fpath := range o.merge(br) {
+			if strings.HasPrefix(fpath, name+"/") {
+				return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+
+	if _, ok := o.files[name]; ok {
+		delete(o.files, name)
+		i := sort.SearchStrings(o.paths, name)
+		o.paths = append(o.paths[:i], o.paths[i+1:]...)
+	}
+	if _, ok := br.files[name]; ok {
+		o.removed[name] = true
+	}
+	return nil
+}
+
+// lookup returns the named file, as seen through the overlay.
+func (br *Broccoli) lookup(name string) (*File, bool) {
+	o := br.overlay
+	if o == nil {
+		f, ok := br.files[name]
+		return f, ok
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.find(br, name)
+}
+
+// paths returns the sorted paths of the files, as seen through
+// the overlay.
+func (br *Broccoli) paths() []string {
+	o := br.overlay
+	if o == nil {
+		return br.filePaths
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.merge(br)
+}
+
+// find looks up the file, it must be called with the lock held.
+func (o *overlay) find(br *Broccoli, name string) (*File, bool) {
+	if f, ok := o.files[name]; ok {
+		return f, true
+	}
+	if o.removed[name] {
+		return nil, false
+	}
+	if f, ok := br.files[name]; ok || !br.fold {
+		return f, ok
+	}
+
+	for _, fpath := range o.paths {
+		if strings.EqualFold(fpath, name) {
+			return o.files[fpath], true
+		}
+	}
+	if f, ok := br.bundled(name); ok && !o.removed[f.Fpath] {
+		return f, true
+	}
+	return nil, false
+}
+
+// merge returns the sorted paths of both the bundled and the written
+// files, it must be called with the lock held.
+func (o *overlay) merge(br *Broccoli) []string {
+	if len(o.paths) == 0 && len(o.removed) == 0 {
+		return br.filePaths
+	}
+
+	paths := make([]string, 0, len(br.filePaths)+len(o.paths))
+	a, b := br.filePaths, o.paths
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] < b[0]:
+			if !o.removed[a[0]] {
+				paths = append(paths, a[0])
+			}
+			a = a[1:]
+		case len(a) > 0 && a[0] == b[0]:
+			a = a[1:]
+		default:
+			paths = append(paths, b[0])
+			b = b[1:]
+		}
+	}
+	return paths
+}
+
+// put adds the file, it must be called with the lock held.
+func (o *overlay) put(f *File) {
+	if _, ok := o.files[f.Fpath]; !ok {
+		i := sort.SearchStrings(o.paths, f.Fpath)
+		o.paths = append(o.paths, "")
+		copy(o.paths[i+1:], o.paths[i:])
+		o.paths[i] = f.Fpath
+	}
+
+	o.files[f.Fpath] = f
+	delete(o.removed, f.Fpath)
+}
+
+// checkParent makes sure the parent directory of the named file
+// exists and returns the path of the file within, as it's cased in
+// the case-insensitive mode, it must be called with the lock held.
+func (o *overlay) checkParent(br *Broccoli, op, name string) (string, error) {
+	if name == "" || name == "." {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+
+	dir := path.Dir(name)
+	if dir == "." {
+		return name, nil
+	}
+
+	f, ok := o.find(br, dir)
+	switch {
+	case !ok:
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case !f.IsDir():
+		return "", &os.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return path.Join(f.Fpath, path.Base(name)), nil
+}
+
+// overlayWriter buffers the data written to the file made by Create.
+type overlayWriter struct {
+	br     *Broccoli
+	name   string
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *overlayWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *overlayWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	return w.br.WriteFile(w.name, w.buf.Bytes())
+}
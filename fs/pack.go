@@ -2,66 +2,182 @@ package fs
 
 import (
 	"bytes"
+	"container/list"
+	"crypto/cipher"
 	"encoding/gob"
+	"io"
+	"os"
+	"path"
 	"runtime"
 	"sort"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/pkg/errors"
 )
 
+// PackOptions control how the bundle is packed.
+type PackOptions struct {
+	// Quality is the brotli compression level (1-11).
+	Quality int
+	// Key, if set, is the AES key (16, 24 or 32 bytes long) used
+	// to encrypt the compressed files with AES-GCM.
+	Key []byte
+	// Root is the directory of the file system packed by PackFS,
+	// the whole file system by default. The paths in the bundle
+	// are relative to it, as with fs.Sub.
+	Root string
+	// CaseInsensitive marks the bundle for the case-insensitive
+	// lookups, see Broccoli.CaseInsensitive. The paths, which only
+	// differ in case, are rejected.
+	CaseInsensitive bool
+}
+
 // Pack compresses a set of files from disk for bundled use in the generated code.
+// The checksums of the files are computed, unless provided.
 //
 // This function is only supposed to be called by broccoli the tool.
 func Pack(files []*File, quality int) ([]byte, error) {
+	return PackWith(files, PackOptions{Quality: quality})
+}
+
+// PackWith is like Pack, but it takes the options.
+//
+// This function is only supposed to be called by broccoli the tool.
+func PackWith(files []*File, opts PackOptions) ([]byte, error) {
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].Fpath < files[j].Fpath
 	})
 
-	n := runtime.NumCPU()
-	feed := make(chan *File)
-	errs := make(chan error, n)
-	defer close(errs)
+	var (
+		aead cipher.AEAD
+		foot footer
+		err  error
+	)
+	if opts.CaseInsensitive {
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = f.Fpath
+		}
+		if err := foldCollisions(paths); err != nil {
+			return nil, err
+		}
+		foot.Fold = true
+	}
+	if opts.Key != nil {
+		if aead, err = newAEAD(opts.Key); err != nil {
+			return nil, err
+		}
+		if foot.KeyCheck, err = seal(aead, nil, keyCheck); err != nil {
+			return nil, err
+		}
+		foot.Encrypted = true
+	}
 
-	for i := 0; i < n; i++ {
-		go func() {
-			for f := range feed {
-				data, err := f.compress(quality)
-				if err != nil {
-					errs <- err
-					return
-				}
+	var regular []*File
+	for _, f := range files {
+		if !f.IsDir() {
+			regular = append(regular, f)
+		}
+	}
 
-				f.Data = data
+	err = parallel(regular, func(f *File) error {
+		if f.Fhash == nil {
+			f.Fhash = checksum(f.Data)
+		}
+		// The decoder never decompresses more than that.
+		f.Fsize = int64(len(f.Data))
+		data, err := f.compress(opts.Quality)
+		if err != nil {
+			return err
+		}
+
+		if aead != nil {
+			data, err = seal(aead, data, []byte(f.Fpath))
+			if err != nil {
+				return err
 			}
+		}
 
-			errs <- nil
-		}()
+		f.Data = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		feed <- file
+	index := make(map[string]*File, len(files))
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		index[f.Fpath] = f
+		paths = append(paths, f.Fpath)
 	}
-	close(feed)
 
-	for err := range errs {
+	foot.Sum = bundleSum(paths, index)
+	return encode(files, foot, opts.Quality)
+}
+
+// FromMap makes the Broccoli of the files, keyed by the path, with
+// the parent directories in place, which is handy in tests:
+//
+// 	br, err := fs.FromMap(map[string][]byte{
+// 		"public/index.html": []byte("<h1>Hello</h1>"),
+// 	})
+//
+func FromMap(files map[string][]byte) (*Broccoli, error) {
+	var (
+		bundled = make([]*File, 0, len(files))
+		seen    = make(map[string]bool, len(files))
+		now     = time.Now().Unix()
+	)
+	for name, data := range files {
+		fpath, err := clean("frommap", name)
 		if err != nil {
 			return nil, err
 		}
+		switch {
+		case fpath == ".":
+			return nil, &os.PathError{Op: "frommap", Path: name, Err: os.ErrInvalid}
+		case seen[fpath]:
+			return nil, errors.Errorf("duplicate path %s", fpath)
+		}
+		seen[fpath] = true
 
-		n--
-		if n == 0 {
-			break
+		bundled = append(bundled, &File{
+			Data:  data,
+			Fpath: fpath,
+			Fname: path.Base(fpath),
+			Fsize: int64(len(data)),
+			Ftime: now,
+		})
+	}
+	for fpath := range seen {
+		for dir := path.Dir(fpath); dir != "."; dir = path.Dir(dir) {
+			if seen[dir] {
+				return nil, &os.PathError{Op: "frommap", Path: fpath, Err: errNotDir}
+			}
 		}
 	}
 
+	bundle, err := PackWith(bundled, PackOptions{Quality: 1})
+	if err != nil {
+		return nil, err
+	}
+	return Load(bundle, LoadOptions{})
+}
+
+// encode writes the bundle of the sorted, compressed files.
+func encode(files []*File, foot footer, quality int) ([]byte, error) {
 	var b bytes.Buffer
+	b.WriteString(bundleMagic)
+	b.WriteByte(bundleVersion)
 	w := brotli.NewWriterLevel(&b, quality)
-	if err := gob.NewEncoder(w).Encode(files); err != nil {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(files); err != nil {
+		return nil, err
+	}
+	// The older decoders only read the files.
+	if err := enc.Encode(foot); err != nil {
 		return nil, err
 	}
 
@@ -72,49 +188,241 @@ func Pack(files []*File, quality int) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// footer follows the files in the bundle.
+type footer struct {
+	Sum []byte // bundle checksum
+
+	Encrypted bool
+	KeyCheck  []byte // sealed keyCheck, to tell the wrong keys apart
+
+	Fold bool // case-insensitive lookups
+}
+
 // New decompresses the bundle byte-slice and creates a virtual file system.
 // Depending on whether if optional decompression is enabled, it will or
-// will not decompress the files while loading them.
+// will not decompress the files while loading them. With optional
+// decompression, the files marked Eager are decompressed regardless.
 //
 // This function is only supposed to be called from the generated code.
 func New(opt bool, bundle []byte) *Broccoli {
-	var files []*File
-	r := brotli.NewReader(bytes.NewBuffer(bundle))
-	if err := gob.NewDecoder(r).Decode(&files); err != nil {
+	v := &Broccoli{}
+	if err := v.build(opt, bundle); err != nil {
+		panic(err)
+	}
+	return versioned(v)
+}
+
+// NewLazy is like New, but the bundle is only decoded on the first use
+// of the returned Broccoli, so that the binaries which don't touch the
+// assets don't pay for it.
+//
+// This function is only supposed to be called from the generated code.
+func NewLazy(opt bool, bundle []byte) *Broccoli {
+	br := &Broccoli{}
+	br.lazy = func() {
+		// The settings may precede the first use.
+		v := &Broccoli{observer: br.observer, fold: br.fold}
+		if err := v.build(opt, bundle); err != nil {
+			panic(err)
+		}
+		br.live.Store(v)
+	}
+	return br
+}
+
+// NewAsync is like New, but it returns immediately, while the files
+// are decompressed in the background: the ones marked Eager first,
+// then the rest, smaller files first. Open only waits for the file
+// it needs, use Ready to wait for all of them.
+//
+// The decompression errors are reported by Open.
+//
+// This function is only supposed to be called from the generated code.
+func NewAsync(opt bool, bundle []byte) *Broccoli {
+	v := &Broccoli{}
+	eager, err := v.decode(opt, bundle)
+	if err != nil {
 		panic(err)
 	}
 
-	br := &Broccoli{
-		filePaths: make([]string, 0, len(files)),
-		files:     map[string]*File{},
+	sort.SliceStable(eager, func(i, j int) bool {
+		a, b := eager[i], eager[j]
+		if a.Eager != b.Eager {
+			return a.Eager
+		}
+		return len(a.Data) < len(b.Data)
+	})
+
+	go func() {
+		// Errors will resurface on Open.
+		_ = parallel(eager, func(f *File) error {
+			_, err := v.load(f)
+			return err
+		})
+		close(v.ready)
+	}()
+
+	return versioned(v)
+}
+
+// build decodes the bundle and decompresses the files at startup.
+func (br *Broccoli) build(opt bool, bundle []byte) error {
+	eager, err := br.decode(opt, bundle)
+	if err != nil {
+		return err
+	}
+
+	err = parallel(eager, func(f *File) error {
+		_, err := br.load(f)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not decompress")
+	}
+
+	close(br.ready)
+	return nil
+}
+
+// decode decodes the bundle into br and returns the files
+// to be decompressed at startup.
+func (br *Broccoli) decode(opt bool, bundle []byte) ([]*File, error) {
+	version, payload, err := header(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		files []*File
+		foot  footer
+	)
+	err = safely(func() error {
+		// The index holds the compressed data mostly, the limit
+		// only guards against the decompression bombs.
+		limit := int64(len(payload)) << 10
+		if limit < 1<<20 {
+			limit = 1 << 20
+		}
+
+		r := &limitReader{brotli.NewReader(bytes.NewReader(payload)), limit}
+		dec := gob.NewDecoder(r)
+		if err := dec.Decode(&files); err != nil {
+			return corrupt(err)
+		}
+		// The bundles generated by the older versions have no footer.
+		if err := dec.Decode(&foot); err != nil && err != io.EOF {
+			return corrupt(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i] != nil && (files[j] == nil || files[i].Fpath < files[j].Fpath)
+	})
+	if err := checkIndex(files); err != nil {
+		return nil, err
 	}
+	if files, err = addParents(files); err != nil {
+		return nil, err
+	}
+
+	br.filePaths = make([]string, 0, len(files))
+	br.files = map[string]*File{}
+	br.cache.lru = list.New()
+	br.overlay = newOverlay()
+	br.ready = make(chan struct{})
+	br.sum = foot.Sum
+	br.version = version
+	br.encrypted = foot.Encrypted
+	br.keyCheck = foot.KeyCheck
+	br.fold = br.fold || foot.Fold
 
+	var eager []*File
 	for _, f := range files {
 		f.compressed = true
 		f.br = br
+		// The encrypted files are only decrypted on Open.
+		if !f.IsDir() && !br.encrypted && (!opt || f.Eager) {
+			f.eager = true
+			eager = append(eager, f)
+		}
 
 		br.files[f.Fpath] = f
 		br.filePaths = append(br.filePaths, f.Fpath)
 	}
 
-	if opt {
-		return br
+	return eager, nil
+}
+
+// addParents synthesizes the missing ancestor directories of the
+// files, the root "." included, as new as the newest file within.
+func addParents(files []*File) ([]*File, error) {
+	index := make(map[string]*File, len(files))
+	for _, f := range files {
+		index[f.Fpath] = f
+	}
+
+	n := len(files)
+	for _, f := range files[:n] {
+		t := f.Ftime
+		if t < 0 {
+			t = -t
+		}
+
+		// The absolute paths are rejected by checkIndex, yet
+		// they must not loop forever, as path.Dir("/") is "/".
+		for dir := f.Fpath; dir != "." && dir != "/"; {
+			dir = path.Dir(dir)
+			d, ok := index[dir]
+			if !ok {
+				d = &File{
+					Fpath:     dir,
+					Fname:     path.Base(dir),
+					Ftime:     -1,
+					synthetic: true,
+				}
+				index[dir] = d
+				files = append(files, d)
+			}
+
+			switch {
+			case !d.IsDir():
+				return nil, errors.Wrapf(ErrCorrupt, "%s is not a directory", dir)
+			case d.synthetic && -d.Ftime < t:
+				d.Ftime = -t
+			}
+		}
 	}
 
+	if len(files) > n {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Fpath < files[j].Fpath
+		})
+	}
+	return files, nil
+}
+
+// parallel calls fn for each of the files from NumCPU goroutines,
+// it returns the first error encountered, if any.
+func parallel(files []*File, fn func(*File) error) error {
 	n := runtime.NumCPU()
 	feed := make(chan *File)
-	done := make(chan struct{}, n)
-	defer close(done)
+	errs := make(chan error, n)
 
 	for i := 0; i < n; i++ {
 		go func() {
+			var first error
 			for f := range feed {
-				if err := f.decompress(f.Data); err != nil {
-					panic(errors.Wrap(err, "could not decompress"))
+				if first != nil {
+					continue
 				}
+				first = fn(f)
 			}
 
-			done <- struct{}{}
+			errs <- first
 		}()
 	}
 
@@ -123,12 +431,11 @@ func New(opt bool, bundle []byte) *Broccoli {
 	}
 	close(feed)
 
-	for range done {
-		n--
-		if n == 0 {
-			break
+	var first error
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
 		}
 	}
-
-	return br
+	return first
 }
@@ -0,0 +1,365 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// The patches start with the magic followed by the format version.
+const (
+	patchMagic   = "\x89BRP"
+	patchVersion = 1
+)
+
+var (
+	// ErrPatchMismatch is returned when the patch was made
+	// against another bundle.
+	ErrPatchMismatch = errors.New("patch doesn't match the bundle")
+
+	errPatchEncrypted = errors.New("encrypted bundles can't be patched")
+)
+
+// patch turns one bundle into another, it lists the added or
+// changed files, along with their binary deltas, and the removed ones.
+type patch struct {
+	From, To []byte // checksums of the bundles
+	Quality  int    // compression level of the new files
+	Fold     bool   // case-insensitive lookups of the new bundle
+
+	Files   []patchFile
+	Removed []string
+}
+
+type patchFile struct {
+	File *File     // metadata, without the data
+	Base string    // path of the old file the delta applies to, if any
+	Ops  []deltaOp // empty for the directories
+}
+
+// Diff computes the patch turning the old bundle into the new one,
+// both generated by broccoli the tool, the patch is compressed with
+// the given brotli quality, just as the new files, once patched.
+//
+// Only the files changed are included in the patch, as binary deltas
+// against their previous versions, or against the files with the same
+// contents elsewhere in the old bundle, if renamed.
+//
+// This function is only supposed to be called by broccoli the tool.
+func Diff(old, new []byte, quality int) ([]byte, error) {
+	from, err := decodeForPatch(old)
+	if err != nil {
+		return nil, errors.Wrap(err, "old bundle")
+	}
+	to, err := decodeForPatch(new)
+	if err != nil {
+		return nil, errors.Wrap(err, "new bundle")
+	}
+
+	p := patch{
+		From:    bundleSum(from.filePaths, from.files),
+		To:      bundleSum(to.filePaths, to.files),
+		Quality: quality,
+		Fold:    to.fold,
+	}
+
+	// The files are found by content, when renamed.
+	hashes := map[string]*File{}
+	for _, fpath := range from.filePaths {
+		if f := from.files[fpath]; !f.IsDir() {
+			hashes[string(f.Fhash)] = f
+		}
+	}
+
+	for _, fpath := range to.filePaths {
+		f := to.files[fpath]
+		base, ok := from.files[fpath]
+		if f.synthetic || ok && !base.synthetic && sameFile(base, f) {
+			continue
+		}
+
+		pf := patchFile{File: f.meta()}
+		if f.IsDir() {
+			p.Files = append(p.Files, pf)
+			continue
+		}
+
+		if !ok || base.IsDir() {
+			base = hashes[string(f.Fhash)]
+		}
+
+		var prev []byte
+		if base != nil {
+			pf.Base = base.Fpath
+			if prev, err = from.unpack(base, base.Data); err != nil {
+				return nil, errors.Wrap(err, base.Fpath)
+			}
+		}
+
+		data, err := to.unpack(f, f.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, fpath)
+		}
+		pf.Ops = delta(prev, data)
+		p.Files = append(p.Files, pf)
+	}
+
+	for _, fpath := range from.filePaths {
+		if from.files[fpath].synthetic {
+			continue
+		}
+		if f, ok := to.files[fpath]; !ok || f.synthetic {
+			p.Removed = append(p.Removed, fpath)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(patchMagic)
+	b.WriteByte(patchVersion)
+	w := brotli.NewWriterLevel(&b, quality)
+	if err := gob.NewEncoder(w).Encode(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Patch applies the patch made by Diff to the bundle and returns
+// the new bundle. It fails with ErrPatchMismatch, if the patch was
+// made against another bundle, or with *IntegrityError, if the
+// patched files don't match the checksums of the new bundle.
+//
+// The signatures are not preserved, the new bundle must be signed anew.
+func Patch(bundle, patch []byte) ([]byte, error) {
+	br, err := decodeForPatch(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return br.patch(patch, func(f *File) ([]byte, error) {
+		return br.unpack(f, f.Data)
+	})
+}
+
+// Patch applies the patch made by Diff to the files of br and
+// returns the new virtual file system, with optional decompression,
+// leaving br intact. The errors are the same as those of Patch.
+func (br *Broccoli) Patch(patch []byte) (*Broccoli, error) {
+	if br.devMode {
+		return nil, errors.New("could not patch in development mode")
+	}
+	if br.parent != nil {
+		return nil, errSubView
+	}
+	br = br.init()
+	if br.encrypted {
+		return nil, errPatchEncrypted
+	}
+
+	bundle, err := br.patch(patch, br.load)
+	if err != nil {
+		return nil, err
+	}
+	return Load(bundle, LoadOptions{Optional: true})
+}
+
+// patch applies the patch to the files of br, read by content.
+func (br *Broccoli) patch(b []byte, content func(*File) ([]byte, error)) ([]byte, error) {
+	p, err := decodePatch(b)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(bundleSum(br.filePaths, br.files), p.From) {
+		return nil, ErrPatchMismatch
+	}
+
+	index := make(map[string]*File, len(br.files))
+	for _, fpath := range br.filePaths {
+		f := br.files[fpath]
+		if f.synthetic {
+			continue
+		}
+		data, err := br.compressed(f, content, p.Quality)
+		if err != nil {
+			return nil, errors.Wrap(err, fpath)
+		}
+
+		index[fpath] = f.meta()
+		index[fpath].Data = data
+	}
+
+	for _, fpath := range p.Removed {
+		if _, ok := index[fpath]; !ok {
+			return nil, ErrPatchMismatch
+		}
+		delete(index, fpath)
+	}
+
+	changes := make(map[*File]patchFile, len(p.Files))
+	var changed []*File
+	for _, pf := range p.Files {
+		if err := checkIndex([]*File{pf.File}); err != nil {
+			return nil, err
+		}
+		changes[pf.File] = pf
+		changed = append(changed, pf.File)
+		index[pf.File.Fpath] = pf.File
+	}
+
+	err = parallel(changed, func(f *File) error {
+		pf := changes[f]
+		if f.IsDir() {
+			return nil
+		}
+
+		var base []byte
+		if pf.Base != "" {
+			old, ok := br.files[pf.Base]
+			if !ok {
+				return ErrPatchMismatch
+			}
+			var err error
+			if base, err = content(old); err != nil {
+				return errors.Wrap(err, old.Fpath)
+			}
+			if old.Fhash != nil && !bytes.Equal(checksum(base), old.Fhash) {
+				return &IntegrityError{Paths: []string{old.Fpath}}
+			}
+		}
+
+		data, err := applyDelta(base, pf.Ops, f.Fsize)
+		if err != nil {
+			return errors.Wrap(err, f.Fpath)
+		}
+		if !bytes.Equal(checksum(data), f.Fhash) {
+			return &IntegrityError{Paths: []string{f.Fpath}}
+		}
+
+		f.Data = data
+		f.Data, err = f.compress(p.Quality)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, 0, len(index))
+	paths := make([]string, 0, len(index))
+	for fpath, f := range index {
+		files = append(files, f)
+		paths = append(paths, fpath)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Fpath < files[j].Fpath
+	})
+	sort.Strings(paths)
+
+	if !bytes.Equal(bundleSum(paths, index), p.To) {
+		return nil, &IntegrityError{Bundle: true}
+	}
+	if p.Fold {
+		if err := foldCollisions(paths); err != nil {
+			return nil, err
+		}
+	}
+	return encode(files, footer{Sum: p.To, Fold: p.Fold}, p.Quality)
+}
+
+// compressed returns the compressed data of the file,
+// compressing it anew if it's been decompressed for good.
+func (br *Broccoli) compressed(f *File, content func(*File) ([]byte, error), quality int) ([]byte, error) {
+	if f.IsDir() {
+		return nil, nil
+	}
+
+	br.cache.mu.Lock()
+	data, compressed, raw := f.Data, f.compressed, f.raw
+	br.cache.mu.Unlock()
+
+	switch {
+	case compressed:
+		return data, nil
+	case raw != nil:
+		return raw, nil
+	}
+
+	data, err := content(f)
+	if err != nil {
+		return nil, err
+	}
+	return (&File{Data: data}).compress(quality)
+}
+
+// decodeForPatch decodes the bundle without decompressing the files.
+func decodeForPatch(bundle []byte) (*Broccoli, error) {
+	br := &Broccoli{}
+	if _, err := br.decode(true, bundle); err != nil {
+		return nil, err
+	}
+	if br.encrypted {
+		return nil, errPatchEncrypted
+	}
+
+	for _, f := range br.files {
+		if !f.IsDir() && f.Fhash == nil {
+			return nil, errors.New("bundle has no checksums")
+		}
+	}
+	return br, nil
+}
+
+func decodePatch(b []byte) (*patch, error) {
+	if !bytes.HasPrefix(b, []byte(patchMagic)) || len(b) == len(patchMagic) {
+		return nil, errors.Wrap(ErrCorrupt, "not a patch")
+	}
+	if v := int(b[len(patchMagic)]); v > patchVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "version %d", v)
+	}
+
+	p := new(patch)
+	err := safely(func() error {
+		payload := b[len(patchMagic)+1:]
+		limit := int64(len(payload)) << 10
+		if limit < 1<<20 {
+			limit = 1 << 20
+		}
+
+		r := &limitReader{brotli.NewReader(bytes.NewReader(payload)), limit}
+		if err := gob.NewDecoder(r).Decode(p); err != nil {
+			return corrupt(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.Quality < brotli.BestSpeed || p.Quality > brotli.BestCompression {
+		return nil, errors.Wrapf(ErrCorrupt, "bad quality %d", p.Quality)
+	}
+	return p, nil
+}
+
+// meta returns a copy of the file metadata.
+func (f *File) meta() *File {
+	return &File{
+		Fpath: f.Fpath,
+		Fname: f.Fname,
+		Fsize: f.Fsize,
+		Ftime: f.Ftime,
+		Fhash: f.Fhash,
+		Fsri:  f.Fsri,
+		Eager: f.Eager,
+	}
+}
+
+// sameFile tells whether if the files are identical.
+func sameFile(a, b *File) bool {
+	return a.Fname == b.Fname && a.Fsize == b.Fsize && a.Ftime == b.Ftime &&
+		bytes.Equal(a.Fhash, b.Fhash) && a.Fsri == b.Fsri && a.Eager == b.Eager
+}
@@ -0,0 +1,76 @@
+package fs
+
+import "github.com/pkg/errors"
+
+// Replace atomically swaps the files of br for those of next, loaded
+// at runtime with Load or made with Patch, for instance:
+//
+// 	next, err := fs.Load(bundle, fs.LoadOptions{Verify: true})
+// 	if err != nil {
+// 		return err
+// 	}
+// 	br.Replace(next)
+//
+// The Opens that follow see the new files, while the files already
+// open are read to the end from the previous version, which is then
+// garbage-collected, so the servers keep handling requests meanwhile.
+// The observer, the verification policy, the cache limit, the
+// case-insensitive mode and the files written carry over, the
+// callbacks registered with OnReplace are called once the swap
+// is done.
+//
+// The rules of the servers, read from the bundled configuration
+// files on NewServer, are not reloaded.
+func (br *Broccoli) Replace(next *Broccoli) error {
+	switch {
+	case next == nil:
+		return errors.New("could not replace with nil")
+	case br.parent != nil || next.parent != nil:
+		return errSubView
+	}
+	next = next.init()
+
+	br.replaceMu.Lock()
+	defer br.replaceMu.Unlock()
+
+	cur := br.init()
+	cur.cache.mu.Lock()
+	policy, limit := cur.verify, cur.cache.stats.Limit
+	cur.cache.mu.Unlock()
+
+	next.observer = br.observer
+	next.overlay = cur.overlay
+	next.fold = next.fold || cur.fold
+	next.cache.mu.Lock()
+	next.verify = policy
+	next.cache.stats.Limit = limit
+	next.cache.evict()
+	next.cache.mu.Unlock()
+
+	br.live.Store(next)
+
+	for _, fn := range br.onReplace {
+		fn()
+	}
+	return nil
+}
+
+// versioned returns the Broccoli holding v as its first version,
+// so that the files of v are let go of once replaced, just like
+// those of the versions that follow.
+func versioned(v *Broccoli) *Broccoli {
+	br := &Broccoli{}
+	br.live.Store(v)
+	return br
+}
+
+// OnReplace registers the callback to be called after each Replace,
+// to invalidate the caches derived from the files, for instance.
+// The callbacks are called one at a time, in order of registration,
+// they must not call Replace.
+func (br *Broccoli) OnReplace(fn func()) {
+	br = br.base()
+	br.replaceMu.Lock()
+	br.onReplace = append(br.onReplace, fn)
+	br.replaceMu.Unlock()
+}
@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pattern is a compiled Netlify-style path pattern, where ":name"
+// matches a single path segment and the trailing "*" matches the
+// rest of the path, the splat.
+type pattern struct {
+	raw   string
+	segs  []string
+	splat bool
+}
+
+func compilePattern(raw string) (*pattern, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, errors.Errorf("pattern %q must start with /", raw)
+	}
+
+	p := &pattern{raw: raw, segs: splitPath(raw)}
+	for i, seg := range p.segs {
+		switch {
+		case seg == "*":
+			if i != len(p.segs)-1 {
+				return nil, errors.Errorf("pattern %q: * must be the last segment", raw)
+			}
+			p.segs, p.splat = p.segs[:i], true
+		case strings.Contains(seg, "*"):
+			return nil, errors.Errorf("pattern %q: * must be a whole segment", raw)
+		case seg == ":":
+			return nil, errors.Errorf("pattern %q: empty placeholder name", raw)
+		}
+	}
+
+	return p, nil
+}
+
+// match reports whether if the path matches the pattern and returns
+// the values of placeholders; the splat is stored under ":splat".
+// With fold, the segments match regardless of case.
+func (p *pattern) match(upath string, fold bool) (map[string]string, bool) {
+	segs := splitPath(upath)
+	if len(segs) < len(p.segs) || !p.splat && len(segs) != len(p.segs) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, seg := range p.segs {
+		if strings.HasPrefix(seg, ":") {
+			params[seg] = segs[i]
+		} else if seg != segs[i] && !(fold && strings.EqualFold(seg, segs[i])) {
+			return nil, false
+		}
+	}
+	if p.splat {
+		params[":splat"] = strings.Join(segs[len(p.segs):], "/")
+	}
+
+	return params, true
+}
+
+// splitPath splits the slash-separated path into segments,
+// ignoring the leading and trailing slashes.
+func splitPath(upath string) []string {
+	upath = strings.Trim(upath, "/")
+	if upath == "" {
+		return nil
+	}
+	return strings.Split(upath, "/")
+}
+
+type headerRule struct {
+	pattern *pattern
+	header  http.Header
+}
+
+func (r headerRule) matchAny(paths []string, fold bool) bool {
+	for _, upath := range paths {
+		if _, ok := r.pattern.match(upath, fold); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHeaders parses the Netlify-style _headers file:
+//
+//     # comment
+//     /static/*
+//       Cache-Control: public, max-age=31536000
+//     /index.html
+//       Cache-Control: no-cache
+//
+func parseHeaders(name string, r io.Reader) ([]headerRule, error) {
+	var rules []headerRule
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			p, err := compilePattern(trimmed)
+			if err != nil {
+				return nil, errors.Errorf("%s:%d: %v", name, n, err)
+			}
+			rules = append(rules, headerRule{pattern: p, header: http.Header{}})
+			continue
+		}
+
+		if len(rules) == 0 {
+			return nil, errors.Errorf("%s:%d: header without a path", name, n)
+		}
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: malformed header %q", name, n, trimmed)
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(trimmed[:i]))
+		rules[len(rules)-1].header.Add(key, strings.TrimSpace(trimmed[i+1:]))
+	}
+
+	return rules, sc.Err()
+}
+
+// RedirectRule redirects or rewrites the requests matching the From
+// pattern to the To path or URL, which may refer to placeholders and
+// the splat of the pattern:
+//
+//     fs.RedirectRule{From: "/blog/:year/*", To: "/posts/:year/:splat", Status: 301}
+//
+// Status 200 stands for the internal rewrite, otherwise it's one of
+// 301, 302, 307 or 308. Rules don't apply to the paths of existing
+// files, unless forced.
+type RedirectRule struct {
+	From   string
+	To     string
+	Status int
+	Force  bool
+}
+
+type redirectRule struct {
+	RedirectRule
+	pattern *pattern
+}
+
+func compileRedirect(rule RedirectRule) (*redirectRule, error) {
+	p, err := compilePattern(rule.From)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rule.Status {
+	case http.StatusOK:
+		if !strings.HasPrefix(rule.To, "/") {
+			return nil, errors.Errorf("rewrite %s: target %q must be a local path", rule.From, rule.To)
+		}
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, errors.Errorf("redirect %s: unsupported status %d", rule.From, rule.Status)
+	}
+
+	for _, name := range placeholders(rule.To) {
+		if name == ":splat" && !p.splat {
+			return nil, errors.Errorf("redirect %s: :splat used without *", rule.From)
+		}
+		if name != ":splat" && !contains(p.segs, name) {
+			return nil, errors.Errorf("redirect %s: placeholder %s is not defined", rule.From, name)
+		}
+	}
+
+	return &redirectRule{rule, p}, nil
+}
+
+// target substitutes the placeholders in the rule's destination.
+func (r *redirectRule) target(params map[string]string) string {
+	names := placeholders(r.To)
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	to := r.To
+	for _, name := range names {
+		to = strings.Replace(to, name, params[name], -1)
+	}
+	return to
+}
+
+// placeholders returns the ":name" placeholders found in s.
+func placeholders(s string) (names []string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' || i+1 == len(s) || !isLetter(s[i+1]) {
+			continue
+		}
+
+		j := i + 1
+		for j < len(s) && (isLetter(s[j]) || s[j] >= '0' && s[j] <= '9') {
+			j++
+		}
+		names = append(names, s[i:j])
+		i = j - 1
+	}
+	return
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRedirects parses the Netlify-style _redirects file, where each
+// line holds the source pattern, the destination and the optional
+// status code, 301 by default, followed by "!" to force the rule:
+//
+//     # comment
+//     /old-page    /new-page
+//     /docs/*      /docs/index.html   200
+//     /blog/:id    /posts/:id         302!
+//
+func parseRedirects(name string, r io.Reader) ([]*redirectRule, error) {
+	var rules []*redirectRule
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, errors.Errorf("%s:%d: too many fields", name, n)
+		}
+		if len(fields) < 2 {
+			return nil, errors.Errorf("%s:%d: missing destination", name, n)
+		}
+
+		rule := RedirectRule{
+			From:   fields[0],
+			To:     fields[1],
+			Status: http.StatusMovedPermanently,
+		}
+		if len(fields) == 3 {
+			code := fields[2]
+			if strings.HasSuffix(code, "!") {
+				code, rule.Force = code[:len(code)-1], true
+			}
+
+			status, err := strconv.Atoi(code)
+			if err != nil {
+				return nil, errors.Errorf("%s:%d: malformed status %q", name, n, fields[2])
+			}
+			rule.Status = status
+		}
+
+		compiled, err := compileRedirect(rule)
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: %v", name, n, err)
+		}
+		rules = append(rules, compiled)
+	}
+
+	return rules, sc.Err()
+}
@@ -1,22 +1,192 @@
 package fs
 
 import (
+	"html/template"
+	"io"
+	"mime"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
+// Option configures a Server created by Serve.
+type Option func(*Server)
+
+// Fallback enables the single-page application mode: requests for
+// unknown extension-less paths that accept text/html are answered
+// with the index document instead of 404.
+//
+//     br.Serve("public", fs.Fallback("index.html"))
+//
+func Fallback(index string) Option {
+	return func(s *Server) {
+		s.fallback = "/" + strings.Trim(index, "/")
+	}
+}
+
+// FallbackExclude lists the path prefixes, such as "/api", that must
+// never fall back to the index document.
+func FallbackExclude(prefixes ...string) Option {
+	return func(s *Server) {
+		s.exclude = append(s.exclude, cleanPrefixes(prefixes)...)
+	}
+}
+
+// AssetDirs lists the asset directories, misses under which always
+// result in 404, regardless of the fallback.
+func AssetDirs(dirs ...string) Option {
+	return func(s *Server) {
+		s.assets = append(s.assets, cleanPrefixes(dirs)...)
+	}
+}
+
+// IndexFiles sets the names of the documents served for directory
+// requests, in order of preference; "index.html" by default.
+func IndexFiles(names ...string) Option {
+	return func(s *Server) {
+		s.indexes = names
+	}
+}
+
+// DirListing controls how the directories without an index
+// document are rendered; ListingHTML by default.
+func DirListing(mode ListingMode) Option {
+	return func(s *Server) {
+		s.listing = mode
+	}
+}
+
+// ListingTemplate renders the directory listings with a user-supplied
+// template, which is executed with a *DirList value.
+func ListingTemplate(t *template.Template) Option {
+	return func(s *Server) {
+		s.listing = listingTemplate
+		s.template = t
+	}
+}
+
+// RedirectSlash controls the canonical trailing-slash redirects:
+// directories are redirected to the path ending in slash, and files
+// to the path without it. Enabled by default.
+func RedirectSlash(enabled bool) Option {
+	return func(s *Server) {
+		s.redirect = enabled
+	}
+}
+
+// ErrorHandler is called whenever the Server fails to serve a request
+// with the HTTP status code and the underlying error.
+//
+// If the handler doesn't write a response, the Server proceeds with
+// the error page, if any, or the plain-text error message.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// ErrorPage serves the bundled document at path, relative to the
+// served directory, as the response body for the status code.
+//
+//     br.Serve("public", fs.ErrorPage(404, "404.html"))
+//
+func ErrorPage(status int, path string) Option {
+	return func(s *Server) {
+		if s.pages == nil {
+			s.pages = map[int]string{}
+		}
+		s.pages[status] = "/" + strings.Trim(path, "/")
+	}
+}
+
+// OnError sets the hook called on every error response.
+func OnError(h ErrorHandler) Option {
+	return func(s *Server) {
+		s.onError = h
+	}
+}
+
+// Headers adds the response headers to every file served under the
+// path pattern, where ":name" matches a single path segment and the
+// trailing "*" matches the rest of the path:
+//
+//     br.Serve("public",
+//         fs.Headers("/static/*", http.Header{
+//             "Cache-Control": {"public, max-age=31536000"},
+//         }),
+//         fs.Headers("/index.html", http.Header{
+//             "Cache-Control": {"no-cache"},
+//         }))
+//
+// The rules from the _headers file in the served directory, if any,
+// are applied first; the latter rules override the former ones.
+func Headers(pattern string, header http.Header) Option {
+	return func(s *Server) {
+		s.rawHeaders = append(s.rawHeaders, rawRule{pattern, header})
+	}
+}
+
+// Redirects adds the ordered redirect and rewrite rules, the first
+// matching rule wins. The rules from the _redirects file in the served
+// directory, if any, take precedence.
+func Redirects(rules ...RedirectRule) Option {
+	return func(s *Server) {
+		s.rawRedirects = append(s.rawRedirects, rules...)
+	}
+}
+
 // Serve returns a Server wrapper with specified directory
 // prefix, which can be used as http.Handler.
 //
 // Usage:
 //     http.ListenAndServe(":80", br.Serve("public"))
 //
-func (br *Broccoli) Serve(dir string) http.Handler {
+// Serve panics if the configuration is invalid, see NewServer.
+func (br *Broccoli) Serve(dir string, opts ...Option) http.Handler {
+	srv, err := br.NewServer(dir, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return srv
+}
+
+// NewServer creates a Server with specified directory prefix, it
+// returns an error if the rules, either passed as options or read
+// from the bundled configuration files, are invalid.
+func (br *Broccoli) NewServer(dir string, opts ...Option) (*Server, error) {
 	srv := &Server{
-		br:     br,
-		prefix: strings.Trim(dir, "/"),
+		br:       br,
+		prefix:   strings.Trim(dir, "/"),
+		indexes:  []string{"index.html"},
+		listing:  ListingHTML,
+		redirect: true,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+
+	if err := srv.loadHeaders(); err != nil {
+		return nil, err
+	}
+	if err := srv.loadRedirects(); err != nil {
+		return nil, err
 	}
-	return http.FileServer(srv)
+
+	return srv, nil
+}
+
+// ServeSPA is a shorthand for Serve with the Fallback option, it
+// serves the single-page application from dir, where unknown routes
+// are answered with the index document.
+//
+// Usage:
+//     http.ListenAndServe(":80", br.ServeSPA("public", "index.html",
+//         fs.FallbackExclude("/api"), fs.AssetDirs("/js", "/css")))
+//
+func (br *Broccoli) ServeSPA(dir, index string, opts ...Option) http.Handler {
+	return br.Serve(dir, append([]Option{Fallback(index)}, opts...)...)
 }
 
 // Server implements a http.FileSystem and provides
@@ -24,10 +194,456 @@ func (br *Broccoli) Serve(dir string) http.Handler {
 type Server struct {
 	br     *Broccoli
 	prefix string
+
+	fallback string   // index document for unknown routes
+	exclude  []string // prefixes that never fall back
+	assets   []string // prefixes that always 404 on miss
+
+	indexes  []string // directory index documents
+	listing  ListingMode
+	template *template.Template
+	redirect bool // trailing-slash redirects
+
+	pages   map[int]string // error documents by status code
+	onError ErrorHandler
+
+	rawHeaders []rawRule
+	headers    []headerRule
+
+	rawRedirects []RedirectRule
+	redirects    []*redirectRule
+}
+
+// rawRule is a header rule before it's compiled.
+type rawRule struct {
+	pattern string
+	header  http.Header
+}
+
+// The bundled configuration files, which are never served.
+const (
+	headersFile   = "/_headers"
+	redirectsFile = "/_redirects"
+)
+
+// hidden tells whether if the cleaned path is one of the
+// configuration files, which are never served nor listed. The case
+// is ignored, as the bundle or the local file system may fold it.
+func (s *Server) hidden(name string) bool {
+	return strings.EqualFold(name, headersFile) || strings.EqualFold(name, redirectsFile)
+}
+
+// folds tells whether if the paths are matched regardless of case,
+// see Broccoli.CaseInsensitive.
+func (s *Server) folds() bool {
+	br := s.br.base()
+	return !br.devMode && br.init().fold
 }
 
 // Open opens the named file for reading. Filepath
 // will be prepended with Server's prefix.
 func (s *Server) Open(filepath string) (http.File, error) {
-	return s.br.Open(s.prefix + filepath)
+	name, err := s.resolve("open", filepath)
+	if err != nil {
+		return nil, err
+	}
+	return s.br.Open(name)
+}
+
+// stat returns a FileInfo describing the named file under the prefix.
+func (s *Server) stat(filepath string) (os.FileInfo, error) {
+	name, err := s.resolve("stat", filepath)
+	if err != nil {
+		return nil, err
+	}
+	return s.br.Stat(name)
+}
+
+// resolve returns the path of the named file under the prefix,
+// the names escaping the prefix are rejected.
+func (s *Server) resolve(op, filepath string) (string, error) {
+	name, err := clean(op, filepath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.prefix, name), nil
+}
+
+// ServeHTTP serves the bundled files, falling back to the index
+// document where it's configured to.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o := s.br.base().observer; o != nil {
+		tw := &trackingWriter{ResponseWriter: w}
+		defer func() {
+			encoding := tw.Header().Get("Content-Encoding")
+			if encoding == "" {
+				encoding = "identity"
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			o.Response(r.URL.Path, tw.status, encoding)
+		}()
+		w = tw
+	}
+
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+		r.URL.Path = upath
+	}
+
+	// The name is resolved once, like Open does, so that neither
+	// the rules nor the configuration files are dodged.
+	cleaned, err := clean("open", upath)
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+	name := path.Join("/", cleaned)
+	if s.hidden(name) {
+		s.serveError(w, r, os.ErrNotExist)
+		return
+	}
+
+	if s.serveRedirect(w, r, name) {
+		return
+	}
+
+	if s.shouldFallback(r, name) {
+		s.serveFallback(w, r, name)
+		return
+	}
+
+	s.serveFile(w, r, name, s.redirect)
+}
+
+// serveRedirect applies the first matching redirect rule, it reports
+// whether if the request has been served.
+func (s *Server) serveRedirect(w http.ResponseWriter, r *http.Request, name string) bool {
+	fold := s.folds()
+	for _, rule := range s.redirects {
+		params, ok := rule.pattern.match(name, fold)
+		if !ok {
+			continue
+		}
+		if !rule.Force {
+			if _, err := s.stat(name); err == nil {
+				return false
+			}
+		}
+
+		to := rule.target(params)
+		if rule.Status != http.StatusOK {
+			if q := r.URL.RawQuery; q != "" && !strings.Contains(to, "?") {
+				to += "?" + q
+			}
+			http.Redirect(w, r, to, rule.Status)
+			return true
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = to
+		s.serveFile(w, r2, path.Clean(to), false)
+		return true
+	}
+
+	return false
+}
+
+func (s *Server) loadRedirects() error {
+	f, err := s.Open(redirectsFile)
+	if err == nil {
+		defer f.Close()
+
+		rules, err := parseRedirects(s.prefix+redirectsFile, f)
+		if err != nil {
+			return err
+		}
+		s.redirects = append(s.redirects, rules...)
+	}
+
+	for _, raw := range s.rawRedirects {
+		rule, err := compileRedirect(raw)
+		if err != nil {
+			return err
+		}
+		s.redirects = append(s.redirects, rule)
+	}
+
+	return nil
+}
+
+func (s *Server) loadHeaders() error {
+	f, err := s.Open(headersFile)
+	if err == nil {
+		defer f.Close()
+
+		rules, err := parseHeaders(s.prefix+headersFile, f)
+		if err != nil {
+			return err
+		}
+		s.headers = append(s.headers, rules...)
+	}
+
+	for _, raw := range s.rawHeaders {
+		p, err := compilePattern(raw.pattern)
+		if err != nil {
+			return err
+		}
+		s.headers = append(s.headers, headerRule{p, raw.header})
+	}
+
+	return nil
+}
+
+// setHeaders sets the headers of all the rules matching any of paths.
+func (s *Server) setHeaders(w http.ResponseWriter, paths ...string) {
+	h, fold := w.Header(), s.folds()
+	for _, rule := range s.headers {
+		if !rule.matchAny(paths, fold) {
+			continue
+		}
+		for key, values := range rule.header {
+			h[textproto.CanonicalMIMEHeaderKey(key)] = values
+		}
+	}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, name string, redirect bool) {
+	if redirect {
+		for _, index := range s.indexes {
+			if strings.HasSuffix(r.URL.Path, "/"+index) {
+				localRedirect(w, r, "./")
+				return
+			}
+		}
+	}
+
+	f, err := s.Open(name)
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+
+	if redirect {
+		upath := r.URL.Path
+		if info.IsDir() {
+			if upath[len(upath)-1] != '/' {
+				localRedirect(w, r, path.Base(upath)+"/")
+				return
+			}
+		} else if upath[len(upath)-1] == '/' {
+			localRedirect(w, r, "../"+path.Base(upath))
+			return
+		}
+	}
+
+	// The rules match the cleaned path, by which the file is found.
+	if !info.IsDir() {
+		s.setHeaders(w, name)
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+
+	for _, index := range s.indexes {
+		ff, err := s.Open(path.Join(name, index))
+		if err != nil {
+			continue
+		}
+		defer ff.Close()
+
+		fi, err := ff.Stat()
+		if err != nil || fi.IsDir() {
+			continue
+		}
+
+		s.setHeaders(w, name, path.Join(name, index))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), ff)
+		return
+	}
+
+	if s.listing == ListingOff {
+		s.serveError(w, r, os.ErrNotExist)
+		return
+	}
+	s.setHeaders(w, name)
+	s.serveListing(w, r, name, f)
+}
+
+func (s *Server) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		status = http.StatusNotFound
+	case os.IsPermission(err):
+		status = http.StatusForbidden
+	case errors.Is(err, os.ErrInvalid):
+		status = http.StatusBadRequest
+	}
+
+	if s.onError != nil {
+		tw := &trackingWriter{ResponseWriter: w}
+		s.onError(tw, r, status, err)
+		if tw.status != 0 {
+			return
+		}
+	}
+
+	if page, ok := s.pages[status]; ok && s.serveErrorPage(w, page, status) {
+		return
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		http.Error(w, "404 page not found", status)
+	case http.StatusForbidden:
+		http.Error(w, "403 Forbidden", status)
+	case http.StatusBadRequest:
+		http.Error(w, "400 Bad Request", status)
+	default:
+		http.Error(w, "500 Internal Server Error", status)
+	}
+}
+
+// serveErrorPage writes the bundled error document with the status
+// code, it reports whether if the document could be opened.
+func (s *Server) serveErrorPage(w http.ResponseWriter, page string, status int) bool {
+	f, err := s.Open(page)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return false
+	}
+
+	ctype := mime.TypeByExtension(path.Ext(page))
+	if ctype == "" {
+		ctype = "text/html; charset=utf-8"
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ctype)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	io.Copy(w, f)
+	return true
+}
+
+// trackingWriter remembers the status code written, if any.
+type trackingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *trackingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// localRedirect gives a Moved Permanently response.
+// It does not convert relative paths to absolute paths like http.Redirect does.
+func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+func (s *Server) shouldFallback(r *http.Request, name string) bool {
+	if s.fallback == "" {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	if strings.HasSuffix(upath, "/") {
+		return false
+	}
+	// The cleaned name, lest the dot segments or the backslashes
+	// sneak past the prefixes.
+	if path.Ext(name) != "" {
+		return false
+	}
+	if fold := s.folds(); hasPrefix(name, s.exclude, fold) || hasPrefix(name, s.assets, fold) {
+		return false
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+
+	_, err := s.stat(name)
+	return err != nil
+}
+
+func (s *Server) serveFallback(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.Open(s.fallback)
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+
+	// The rules of the route apply, as well as those of the document.
+	s.setHeaders(w, name, s.fallback)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func cleanPrefixes(prefixes []string) []string {
+	clean := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		clean = append(clean, "/"+strings.Trim(p, "/"))
+	}
+	return clean
+}
+
+// hasPrefix tells whether if the path is one of prefixes
+// or is located under any of them, regardless of case with fold.
+func hasPrefix(upath string, prefixes []string, fold bool) bool {
+	if fold {
+		upath = strings.ToLower(upath)
+	}
+	for _, p := range prefixes {
+		if fold {
+			p = strings.ToLower(p)
+		}
+		if p == "/" || upath == p || strings.HasPrefix(upath, p+"/") {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	"github.com/pkg/errors"
+)
+
+// signatureMagic terminates the signed bundles, which look like
+//
+//     bundle | ed25519 signature of bundle | signatureMagic
+//
+// The decoders unaware of signatures ignore the trailing bytes.
+const signatureMagic = "\x00broccoli/ed25519"
+
+var (
+	// ErrUnsigned is returned when the bundle has no signature.
+	ErrUnsigned = errors.New("bundle is not signed")
+	// ErrBadSignature is returned when the bundle signature is invalid.
+	ErrBadSignature = errors.New("invalid bundle signature")
+)
+
+// Sign appends the ed25519 signature of the bundle to it.
+//
+// This function is only supposed to be called by broccoli the tool.
+func Sign(bundle []byte, key ed25519.PrivateKey) []byte {
+	sig := ed25519.Sign(key, bundle)
+
+	signed := make([]byte, 0, len(bundle)+len(sig)+len(signatureMagic))
+	signed = append(signed, bundle...)
+	signed = append(signed, sig...)
+	return append(signed, signatureMagic...)
+}
+
+// NewVerified checks the signature of the bundle, loaded from disk
+// for instance, and creates a virtual file system with optional
+// decompression. Unlike New, it returns an error instead of panicking:
+// ErrUnsigned or ErrBadSignature, if the signature is missing or
+// invalid, respectively.
+func NewVerified(bundle []byte, key ed25519.PublicKey) (*Broccoli, error) {
+	return Load(bundle, LoadOptions{Optional: true, PublicKey: key})
+}
+
+// verifySignature returns the bundle stripped of the valid signature.
+func verifySignature(bundle []byte, key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("bad ed25519 public key length %d", len(key))
+	}
+
+	n := len(bundle) - ed25519.SignatureSize - len(signatureMagic)
+	if n < 0 || !bytes.HasSuffix(bundle, []byte(signatureMagic)) {
+		return nil, ErrUnsigned
+	}
+
+	payload, sig := bundle[:n], bundle[n:n+ed25519.SignatureSize]
+	if !ed25519.Verify(key, payload, sig) {
+		return nil, ErrBadSignature
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"html/template"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SRIDigest computes the Subresource Integrity digest of data with
+// one of the sha256, sha384 or sha512 algorithms, e.g. "sha384-...".
+func SRIDigest(algorithm string, data []byte) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", errors.Errorf("unsupported integrity algorithm %q", algorithm)
+	}
+
+	h.Write(data)
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Integrity returns the Subresource Integrity digest of the named
+// file, computed by broccoli the tool with the -sri option.
+//
+// In the development mode, the sha384 digest of the local file is
+// computed instead.
+func (br *Broccoli) Integrity(path string) (string, error) {
+	br, path, err := br.within("integrity", path)
+	if err != nil {
+		return "", err
+	}
+
+	if br.devMode {
+		f, err := os.Open(local(path))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		h := sha512.New384()
+		if _, err := f.WriteTo(h); err != nil {
+			return "", err
+		}
+		return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	}
+
+	br = br.init()
+	f, ok := br.lookup(path)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	if f.Fsri == "" {
+		return "", errors.Errorf("no integrity digest for %s", path)
+	}
+	return f.Fsri, nil
+}
+
+// FuncMap returns the template functions for the files served
+// from dir, which take the URL path of the asset:
+//
+//     integrity "/js/app.js"
+//         the digest, e.g. sha384-...
+//     sri "/js/app.js"
+//         the <script> tag for .js files and the <link> tag for
+//         the others, along with the integrity and crossorigin
+//         attributes.
+//
+// Usage:
+//     tmpl := template.New("").Funcs(br.FuncMap("public"))
+//
+func (br *Broccoli) FuncMap(dir string) template.FuncMap {
+	dir = strings.Trim(dir, "/")
+	integrity := func(src string) (string, error) {
+		return br.Integrity(path.Join(dir, src))
+	}
+
+	return template.FuncMap{
+		"integrity": integrity,
+		"sri": func(src string) (template.HTML, error) {
+			digest, err := integrity(src)
+			if err != nil {
+				return "", err
+			}
+
+			src = template.HTMLEscapeString(src)
+			if path.Ext(src) == ".js" {
+				return template.HTML(fmt.Sprintf(
+					`<script src="%s" integrity="%s" crossorigin="anonymous"></script>`,
+					src, digest)), nil
+			}
+			return template.HTML(fmt.Sprintf(
+				`<link rel="stylesheet" href="%s" integrity="%s" crossorigin="anonymous">`,
+				src, digest)), nil
+		},
+	}
+}
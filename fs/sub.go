@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errSubView = errors.New("not supported by a sub-tree view")
+
+// Sub returns the view of the directory, where the paths are relative
+// to it, such that Open, Stat, Walk, Readdir, Serve and the rest only
+// reach the files within:
+//
+// 	public, err := br.Sub("public")
+// 	if err != nil {
+// 		log.Fatal(err)
+// 	}
+// 	http.ListenAndServe(":80", public.Serve(""))
+//
+// The view shares the files, the cache and the settings with br, the
+// latter set via either of them, and follows Replace, but it can't
+// Patch or Replace the bundle itself.
+func (br *Broccoli) Sub(dir string) (*Broccoli, error) {
+	base, dir, err := br.within("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := base.Stat(dir)
+	switch {
+	case err != nil:
+		return nil, err
+	case !info.IsDir():
+		return nil, &os.PathError{Op: "sub", Path: dir, Err: errNotDir}
+	}
+	// As it's cased in the case-insensitive mode.
+	if f, ok := info.(*File); ok {
+		dir = f.Fpath
+	}
+
+	return &Broccoli{parent: base, dir: dir}, nil
+}
+
+// within resolves the name within the view, if br is one, it returns
+// the Broccoli the view is made of and the path of the file in it.
+func (br *Broccoli) within(op, name string) (*Broccoli, string, error) {
+	name, err := clean(op, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if br.parent == nil {
+		return br, name, nil
+	}
+	return br.parent, path.Join(br.dir, name), nil
+}
+
+// base returns the Broccoli the view is made of, if br is one.
+func (br *Broccoli) base() *Broccoli {
+	if br.parent != nil {
+		return br.parent
+	}
+	return br
+}
+
+// contains tells whether if the file is within the view, if br is one.
+func (br *Broccoli) contains(name string) bool {
+	return br.parent == nil || br.dir == "." ||
+		name == br.dir || strings.HasPrefix(name, br.dir+"/")
+}
+
+// rel returns the path relative to the view, if br is one,
+// of the file found within, either bundled or local.
+func (br *Broccoli) rel(name string) string {
+	if br.parent == nil || br.dir == "." {
+		return name
+	}
+
+	name = strings.TrimLeft(name[len(br.dir):], `/\`)
+	if name == "" {
+		return "."
+	}
+	return name
+}
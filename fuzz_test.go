@@ -0,0 +1,110 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"aletheia.icu/broccoli/fs"
+)
+
+// fuzzBundle packs a few small files, the smaller the seeds,
+// the faster the fuzzing.
+func fuzzBundle(f *testing.F) []byte {
+	var files []*fs.File
+	for path, data := range map[string]string{
+		"index.html":  "<h1>Hello</h1>",
+		"js/app.js":   "console.log('hello')",
+		"js/empty.js": "",
+	} {
+		files = append(files, &fs.File{
+			Data:  []byte(data),
+			Fpath: path,
+			Fname: filepath.Base(path),
+			Fsize: int64(len(data)),
+			Ftime: time.Now().Unix(),
+		})
+	}
+
+	bundle, err := fs.Pack(files, 1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return bundle
+}
+
+// FuzzLoad feeds the decoder arbitrary bundles, which must never
+// make it panic, nor the files decoded from them.
+func FuzzLoad(f *testing.F) {
+	bundle := fuzzBundle(f)
+	f.Add(bundle)
+	f.Add(bundle[5:])
+
+	// the paths, which aren't canonical
+	for _, name := range []string{"/etc/x", "a/../b", `a\b`} {
+		seed, err := fs.Pack([]*fs.File{{Data: []byte("x"), Fpath: name, Fname: "x"}}, 1)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		br, err := fs.Load(b, fs.LoadOptions{Optional: true})
+		if err != nil {
+			return
+		}
+		br.Walk(".", func(path string, info os.FileInfo, err error) error {
+			if f, err := br.Open(path); err == nil {
+				ioutil.ReadAll(f)
+			}
+			return nil
+		})
+	})
+}
+
+// FuzzFileOpen feeds File.Open arbitrary compressed data, which must
+// never decompress beyond the recorded size.
+func FuzzFileOpen(f *testing.F) {
+	bundle := fuzzBundle(f)
+	repack(f, bundle, func(files []*fs.File) []*fs.File {
+		for _, file := range files {
+			if !file.IsDir() {
+				f.Add(file.Data, file.Fsize)
+				f.Add(file.Data, int64(1))
+			}
+		}
+		return files
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte, size int64) {
+		b := repack(t, bundle, func(files []*fs.File) []*fs.File {
+			for _, file := range files {
+				if file.Fpath == "index.html" {
+					file.Data, file.Fsize, file.Fhash = data, size, nil
+				}
+			}
+			return files
+		})
+
+		// the headerless bundles must be just as safe
+		for _, b := range [][]byte{b, b[5:]} {
+			br, err := fs.Load(b, fs.LoadOptions{Optional: true})
+			if err != nil {
+				continue
+			}
+			file, err := openFile(br, "index.html")
+			if err != nil {
+				continue
+			}
+			assert.EqualValues(t, file.Fsize, len(file.Data))
+		}
+	})
+}
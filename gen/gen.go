@@ -0,0 +1,463 @@
+// Package gen implements broccoli the tool, which bundles the static
+// files into Go source code, for the build tooling to call it directly:
+//
+// 	code, err := gen.Generate(ctx, gen.Options{
+// 		Inputs: []string{"public"},
+// 		Output: "public.gen.go",
+// 	})
+//
+// The paths of the inputs are relative to the working directory.
+package gen
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"aletheia.icu/broccoli/fs"
+)
+
+// Options control what is bundled and how the code is generated,
+// the zero value bundles the "public" directory at the highest
+// compression level into the "br" variable.
+type Options struct {
+	// Inputs are the files and directories to bundle,
+	// "public" by default.
+	Inputs []string
+	// Output is the name of the file the code is written to by
+	// Generate, none by default.
+	Output string
+	// Package is the name of the package of the generated code,
+	// the one in the working directory by default.
+	Package string
+	// Variable is the name of the exposed variable, "br" by default.
+	Variable string
+	// BuildTags are the compiler build tags for the generated file,
+	// such as "linux,386 darwin,!cgo", none by default.
+	BuildTags string
+
+	// Include is the wildcard for the files to include, such as
+	// "*.html,*.css", mutually exclusive with Exclude.
+	Include string
+	// Exclude is the wildcard for the files to exclude.
+	Exclude string
+	// Gitignore enables the .gitignore rules parsing in each
+	// directory.
+	Gitignore bool
+
+	// Quality is the brotli compression level (1-11),
+	// the highest by default.
+	Quality int
+	// Optional enables the optional decompression, where the files
+	// are only decompressed on the first time they are read.
+	Optional bool
+	// Eager is the wildcard for the files to decompress at startup,
+	// the rest are decompressed on the first read.
+	Eager string
+	// Lazy is the wildcard for the files to decompress on the first
+	// read, the rest are decompressed at startup. If used along with
+	// Eager, the rest is decompressed according to Optional.
+	Lazy string
+	// Async enables the background decompression at startup,
+	// mutually exclusive with Defer.
+	Async bool
+	// Defer enables the deferred initialization, where the bundle
+	// is only decoded on the first use of the variable.
+	Defer bool
+
+	// SRI is the Subresource Integrity digest algorithm (sha256,
+	// sha384, sha512), the digests are not computed by default.
+	SRI string
+	// Sign, if set, is the key the bundle is signed with, see fs.Sign.
+	Sign ed25519.PrivateKey
+	// Encrypt is the source of the hex-encoded AES key, either
+	// "env:NAME" or "file:path", that the files are encrypted with,
+	// and which the generated code reads the key from at runtime.
+	// It can't be used with Async or Defer.
+	Encrypt string
+	// CaseInsensitive enables the case-insensitive lookups, the
+	// paths that only differ in case are reported as an error.
+	CaseInsensitive bool
+
+	// Logger, if set, receives the progress messages.
+	Logger Logger
+}
+
+// Logger receives the progress messages, *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// OptionError reports the invalid or conflicting options.
+type OptionError struct {
+	Option string // name of the field of Options
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return "invalid option " + e.Option + ": " + e.Err.Error()
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+
+// InputError reports the input file or directory, which
+// could not be bundled.
+type InputError struct {
+	Path string
+	Err  error
+}
+
+func (e *InputError) Error() string {
+	return "input " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+var errDuplicate = errors.New("duplicate path in the input")
+
+// inputError makes the InputError, the path of the underlying
+// os.PathError, if any, is dropped, as it's the same.
+func inputError(path string, err error) error {
+	var perr *os.PathError
+	if errors.As(err, &perr) {
+		err = perr.Err
+	}
+	return &InputError{path, err}
+}
+
+const template = `%s
+package %s
+
+import "aletheia.icu/broccoli/fs"
+
+var %s = fs.%s(%t, []byte(%q))
+`
+
+const encryptedTemplate = `%s
+package %s
+
+import "aletheia.icu/broccoli/fs"
+
+var %s = fs.NewWithKey([]byte(%q), fs.%s)
+`
+
+var goIdentifier = regexp.MustCompile(`^\p{L}[\p{L}0-9_]*$`)
+
+// Generate bundles the inputs and returns the Go source code
+// exposing them, which is also written to Output, if set.
+func Generate(ctx context.Context, opts Options) ([]byte, error) {
+	g, err := newGenerator(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := opts.Package
+	if pkg == "" {
+		p, err := build.ImportDir(".", 0)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse package: %w", err)
+		}
+		pkg = p.Name
+	}
+
+	bundle, err := g.bundle(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	header := "// Code generated by broccoli at %v."
+	header = fmt.Sprintf(header, time.Now().Format(time.RFC3339))
+	if opts.BuildTags != "" {
+		header = "// +build " + opts.BuildTags + "\n\n" + header
+	}
+
+	constructor := "New"
+	if opts.Async {
+		constructor = "NewAsync"
+	} else if opts.Defer {
+		constructor = "NewLazy"
+	}
+
+	code := fmt.Sprintf(template,
+		header, pkg, g.variable, constructor, g.lazyLoading(), bundle)
+	if g.key != nil {
+		code = fmt.Sprintf(encryptedTemplate,
+			header, pkg, g.variable, bundle, g.provider)
+	}
+
+	if opts.Output != "" {
+		err = ioutil.WriteFile(opts.Output, []byte(code), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not write to %s: %w", opts.Output, err)
+		}
+	}
+	return []byte(code), nil
+}
+
+// Bundle bundles the inputs and returns the raw bundle, for loading
+// it at runtime with fs.Load, the code generation options are ignored.
+func Bundle(ctx context.Context, opts Options) ([]byte, error) {
+	g, err := newGenerator(opts)
+	if err != nil {
+		return nil, err
+	}
+	return g.bundle(ctx)
+}
+
+// generator holds the validated options.
+type generator struct {
+	Options
+
+	variable string
+	quality  int
+	key      []byte // encryption key
+	provider string // KeyProvider call for the generated code
+}
+
+// newGenerator validates the options and fills in the defaults.
+func newGenerator(opts Options) (*generator, error) {
+	g := &generator{
+		Options:  opts,
+		variable: opts.Variable,
+		quality:  opts.Quality,
+	}
+
+	if len(g.Inputs) == 0 {
+		g.Inputs = []string{"public"}
+	}
+	if g.variable == "" {
+		g.variable = "br"
+	}
+	if g.quality == 0 {
+		g.quality = 11
+	}
+
+	switch {
+	case !goIdentifier.MatchString(g.variable):
+		return nil, &OptionError{"Variable",
+			fmt.Errorf("%s is not a valid Go identifier", g.variable)}
+	case g.Include != "" && g.Exclude != "":
+		return nil, &OptionError{"Include",
+			errors.New("mutually exclusive with Exclude")}
+	case g.quality < 1 || g.quality > 11:
+		return nil, &OptionError{"Quality",
+			fmt.Errorf("unsupported compression level %d (1-11)", g.quality)}
+	case g.Async && g.Defer:
+		return nil, &OptionError{"Async",
+			errors.New("mutually exclusive with Defer")}
+	case g.Encrypt != "" && (g.Async || g.Defer):
+		return nil, &OptionError{"Encrypt",
+			errors.New("can't be used with Async or Defer")}
+	}
+
+	for _, card := range []struct{ option, patterns string }{
+		{"Include", g.Include},
+		{"Exclude", g.Exclude},
+		{"Eager", g.Eager},
+		{"Lazy", g.Lazy},
+	} {
+		if err := checkPatterns(card.patterns); err != nil {
+			return nil, &OptionError{card.option, err}
+		}
+	}
+
+	if g.SRI != "" {
+		if _, err := fs.SRIDigest(g.SRI, nil); err != nil {
+			return nil, &OptionError{"SRI", err}
+		}
+	}
+
+	if g.Encrypt != "" {
+		var err error
+		g.key, g.provider, err = readKey(g.Encrypt)
+		if err != nil {
+			return nil, &OptionError{"Encrypt", err}
+		}
+	}
+
+	return g, nil
+}
+
+func (g *generator) logf(format string, v ...interface{}) {
+	if g.Logger != nil {
+		g.Logger.Printf(format, v...)
+	}
+}
+
+// bundle packs the inputs into the bundle, signed if requested.
+func (g *generator) bundle(ctx context.Context) ([]byte, error) {
+	var (
+		files []*fs.File
+		cards wildcards
+		state = map[string]bool{}
+
+		total int64
+	)
+
+	if g.Include != "" {
+		cards = append(cards, wildcardFrom(true, g.Include))
+	} else if g.Exclude != "" {
+		cards = append(cards, wildcardFrom(false, g.Exclude))
+	}
+
+	if g.Gitignore {
+		ignores, err := parseGitignores()
+		if err != nil {
+			return nil, fmt.Errorf("cannot open .gitignore: %w", err)
+		}
+		cards = append(cards, ignores...)
+	}
+
+	for _, input := range g.Inputs {
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, inputError(input, err)
+		}
+
+		var f *fs.File
+		if !info.IsDir() {
+			if _, ok := state[input]; ok {
+				return nil, inputError(input, errDuplicate)
+			}
+			state[input] = true
+
+			f, err = fs.NewFile(input)
+			if err != nil {
+				return nil, inputError(input, err)
+			}
+
+			if err := g.annotate(f); err != nil {
+				return nil, err
+			}
+			total += f.Fsize
+			files = append(files, f)
+			continue
+		}
+
+		err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return inputError(path, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !cards.test(info) {
+				g.logf("ignoring %s", path)
+				return nil
+			}
+
+			f, err := fs.NewFile(path)
+			if err != nil {
+				return inputError(path, err)
+			}
+			if _, ok := state[path]; ok {
+				return inputError(path, errDuplicate)
+			}
+
+			if err := g.annotate(f); err != nil {
+				return err
+			}
+			total += f.Fsize
+			state[path] = true
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.logf("total bytes read: %d", total)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	bundle, err := fs.PackWith(files, fs.PackOptions{
+		Quality:         g.quality,
+		Key:             g.key,
+		CaseInsensitive: g.CaseInsensitive,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not compress the input: %w", err)
+	}
+
+	g.logf("total bytes compressed: %d", len(bundle))
+
+	if g.Sign != nil {
+		bundle = fs.Sign(bundle, g.Sign)
+	}
+	return bundle, nil
+}
+
+// annotate sets the per-file metadata according to options.
+func (g *generator) annotate(f *fs.File) (err error) {
+	f.Eager = g.eager(f.Fname)
+	if g.SRI != "" && !f.IsDir() {
+		f.Fsri, err = fs.SRIDigest(g.SRI, f.Data)
+	}
+	return
+}
+
+// lazyLoading tells whether if the bundle is loaded with optional
+// decompression, which is the case once the policy is set per file.
+func (g *generator) lazyLoading() bool {
+	return g.Optional || g.Eager != "" || g.Lazy != ""
+}
+
+// eager tells whether if the file is decompressed at startup,
+// it's only meaningful when the policy is set per file.
+func (g *generator) eager(name string) bool {
+	if g.Eager == "" && g.Lazy == "" {
+		return false
+	}
+	if matchGlob(g.Eager, name) {
+		return true
+	}
+	if matchGlob(g.Lazy, name) {
+		return false
+	}
+
+	switch {
+	case g.Lazy == "":
+		return false
+	case g.Eager == "":
+		return true
+	default:
+		return !g.Optional
+	}
+}
+
+// readKey reads the encryption key from the source, either
+// "env:NAME" or "file:path", and returns the corresponding
+// KeyProvider call for the generated code.
+func readKey(source string) (key []byte, provider string, err error) {
+	var read fs.KeyProvider
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := source[len("env:"):]
+		read = fs.KeyFromEnv(name)
+		provider = fmt.Sprintf("KeyFromEnv(%q)", name)
+	case strings.HasPrefix(source, "file:"):
+		path := source[len("file:"):]
+		read = fs.KeyFromFile(path)
+		provider = fmt.Sprintf("KeyFromFile(%q)", path)
+	default:
+		return nil, "", fmt.Errorf("unknown key source %q, env:NAME or file:path expected", source)
+	}
+
+	key, err = read()
+	return
+}
@@ -0,0 +1,112 @@
+package gen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+type wildcards []wildcard
+
+func (w wildcards) test(info os.FileInfo) bool {
+	for _, card := range w {
+		if !card.test(info) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkPatterns makes sure the comma-separated patterns are valid.
+func checkPatterns(patterns string) error {
+	if patterns == "" {
+		return nil
+	}
+
+	for _, pattern := range splitPatterns(patterns) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob tells whether if the name matches any of the patterns,
+// which are checked beforehand, see checkPatterns.
+func matchGlob(patterns, name string) bool {
+	if patterns == "" {
+		return false
+	}
+
+	for _, pattern := range splitPatterns(patterns) {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+type wildcard interface {
+	test(os.FileInfo) bool
+}
+
+type includeWildcard struct {
+	include  bool
+	patterns []string
+}
+
+func (w includeWildcard) test(info os.FileInfo) bool {
+	if info.IsDir() {
+		return true
+	}
+
+	pass := !w.include
+	for _, pattern := range w.patterns {
+		if match, _ := filepath.Match(pattern, info.Name()); match {
+			pass = w.include
+			break
+		}
+	}
+
+	return pass
+}
+
+func wildcardFrom(include bool, patterns string) wildcard {
+	return includeWildcard{include, splitPatterns(patterns)}
+}
+
+func splitPatterns(patterns string) []string {
+	w := strings.Split(patterns, ",")
+	for i, v := range w {
+		w[i] = strings.Trim(v, ` "`)
+	}
+	return w
+}
+
+type gitignoreWildcard struct {
+	ign *ignore.GitIgnore
+}
+
+func (w gitignoreWildcard) test(info os.FileInfo) bool {
+	return !w.ign.MatchesPath(info.Name())
+}
+
+func parseGitignores() (cards []wildcard, err error) {
+	err = filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() == ".gitignore" {
+			ign, err := ignore.CompileIgnoreFile(path)
+			if err != nil {
+				return err
+			}
+			cards = append(cards, gitignoreWildcard{ign: ign})
+		}
+		return nil
+	})
+	return
+}
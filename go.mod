@@ -4,7 +4,10 @@ go 1.13
 
 require (
 	aletheia.icu/broccoli/fs v0.0.0-20200420162907-e7ff440cf358
+	github.com/andybalholm/brotli v1.0.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/sabhiram/go-gitignore v0.0.0-20180611051255-d3107576ba94
 	github.com/stretchr/testify v1.5.1
 )
+
+replace aletheia.icu/broccoli/fs => ./fs
@@ -0,0 +1,107 @@
+//go:build go1.16
+// +build go1.16
+
+package main
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"aletheia.icu/broccoli/fs"
+)
+
+func TestFS(t *testing.T) {
+	fsys := bundleWith(t, nil).FS()
+	assert.NoError(t, fstest.TestFS(fsys,
+		"testdata/index.html", "testdata/js/googleJS.js", "testdata/readdir/1.txt"))
+
+	matches, err := iofs.Glob(fsys, "testdata/**/*.txt")
+	assert.NoError(t, err)
+	assert.Len(t, matches, 3)
+
+	var paths []string
+	err = iofs.WalkDir(fsys, "testdata/js", func(path string, d iofs.DirEntry, err error) error {
+		paths = append(paths, path)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"testdata/js",
+		"testdata/js/.gitignore",
+		"testdata/js/googleJS.js",
+		"testdata/js/youtubescript",
+		"testdata/js/youtubescript/contents",
+		"testdata/js/youtubescript/contents/youtube.js",
+		"testdata/js/youtubescript/webcomponents.js",
+	}, paths)
+
+	f, err := fsys.Open("testdata/readdir")
+	assert.NoError(t, err)
+	dir := f.(iofs.ReadDirFile)
+	entries, err := dir.ReadDir(2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	entries, err = dir.ReadDir(-1)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	entries, err = dir.ReadDir(-1)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = dir.ReadDir(1)
+	assert.Equal(t, io.EOF, err)
+
+	info, err := iofs.Stat(fsys, "testdata/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "index.html", info.Name())
+
+	for _, name := range []string{"/testdata/index.html", `testdata\index.html`, "testdata/../main.go"} {
+		_, err = fsys.Open(name)
+		assert.True(t, errors.Is(err, iofs.ErrInvalid), name)
+	}
+}
+
+func TestPackFS(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	fsys := fstest.MapFS{
+		"site/public/index.html":   {Data: []byte("<h1>Hello</h1>"), ModTime: mtime},
+		"site/public/js/app.js":    {Data: []byte("app()")},
+		"site/public/js":           {Mode: iofs.ModeDir},
+		"site/templates/base.tmpl": {Data: []byte("{{.}}")},
+	}
+
+	bundle, err := fs.PackFS(fsys, fs.PackOptions{Quality: 1, Root: "site/public"})
+	assert.NoError(t, err)
+	br := fs.New(false, bundle)
+
+	info, err := br.Stat("index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, mtime, info.ModTime())
+	assert.Equal(t, int64(14), info.Size())
+
+	info, err = br.Stat("js")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	info, err = br.Stat("js/app.js")
+	assert.NoError(t, err)
+	assert.False(t, info.IsDir())
+
+	for _, name := range []string{"site/public/index.html", "templates/base.tmpl"} {
+		_, err = br.Stat(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	bundle, err = fs.PackFS(fsys, fs.PackOptions{Quality: 1})
+	assert.NoError(t, err)
+	_, err = fs.New(false, bundle).Stat("site/templates/base.tmpl")
+	assert.NoError(t, err)
+
+	_, err = fs.PackFS(fsys, fs.PackOptions{Quality: 1, Root: "missing"})
+	assert.True(t, errors.Is(err, iofs.ErrNotExist))
+}
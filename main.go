@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
 	"strings"
-	"time"
+
+	"aletheia.icu/broccoli/fs"
+	"aletheia.icu/broccoli/gen"
 )
 
 var (
@@ -19,7 +24,16 @@ var (
 	flagExclude   = flag.String("exclude", "", "")
 	flagBuild     = flag.String("build", "", "")
 	flagOptional  = flag.Bool("opt", false, "")
+	flagEager     = flag.String("eager", "", "")
+	flagLazy      = flag.String("lazy", "", "")
+	flagAsync     = flag.Bool("async", false, "")
+	flagDefer     = flag.Bool("defer", false, "")
+	flagSRI       = flag.String("sri", "", "")
+	flagSign      = flag.String("sign", "", "")
+	flagBundle    = flag.String("bundle", "", "")
+	flagEncrypt   = flag.String("encrypt", "", "")
 	flagGitignore = flag.Bool("gitignore", false, "")
+	flagNoCase    = flag.Bool("nocase", false, "")
 	flagQuality   = flag.Int("quality", 11, "")
 
 	verbose = flag.Bool("v", false, "")
@@ -49,19 +63,51 @@ Options:
 	-opt
 		Optional decompression: if enabled, files will only be decompressed
 		on the first time they are read.
+	-eager *.html,*.css
+		Wildcard for the files to decompress at startup, the rest will be
+		decompressed on the first read.
+	-lazy *.wasm
+		Wildcard for the files to decompress on the first read, the rest
+		will be decompressed at startup. If used along with -eager, the
+		rest is decompressed according to -opt.
+	-async
+		Background decompression: if enabled, files are decompressed at
+		startup without blocking the package initialization.
+	-defer
+		Deferred initialization: if enabled, the bundle is only decoded
+		on the first use of the variable, rather than at package init.
+	-sri sha384
+		Subresource Integrity digest algorithm (sha256, sha384, sha512),
+		digests are not computed by default.
+	-sign key.pem
+		Appends the ed25519 signature to the bundle, made with the PKCS #8
+		private key, e.g. from "openssl genpkey -algorithm ed25519".
+	-bundle file
+		Writes the raw bundle to file instead of generating Go code,
+		for loading it at runtime with fs.NewVerified.
+	-encrypt env:NAME|file:path
+		Encrypts the files with AES-GCM, using the hex-encoded key from
+		the environment variable or the file, which the generated code
+		reads the key from at runtime as well.
 	-gitignore
 		Enables .gitignore rules parsing in each directory, disabled by default.
+	-nocase
+		Case-insensitive lookups: if enabled, "Logo.PNG" opens "logo.png",
+		the paths that only differ in case are reported as an error.
 	-quality [level]
 		Brotli compression level (1-11), the highest by default.
 
+Commands:
+	diff-patch old new -o patch [-quality level]
+		Writes the binary delta between the raw bundles, made with -bundle,
+		for fs.Patch to turn the old bundle into the new one on the spot.
+
 Generate a broccoli.gen.go file with the variable broccoli:
 	//go:generate broccoli -src assets -o broccoli -var broccoli
 
 Generate a regular public.gen.go file, but include all *.wasm files:
 	//go:generate broccoli -src public -include="*.wasm"`
 
-var goIdentifier = regexp.MustCompile(`^\p{L}[\p{L}0-9_]*$`)
-
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("broccoli: ")
@@ -74,6 +120,10 @@ func main() {
 		flag.Usage()
 		return
 	}
+	if flag.Arg(0) == "diff-patch" {
+		diffPatch(flag.Args()[1:])
+		return
+	}
 
 	var inputs []string
 	if flagInput == nil {
@@ -90,50 +140,124 @@ func main() {
 		output = strings.Split(output, ".")[0] + ".gen.go"
 	}
 
-	variable := *flagVariable
-	if !goIdentifier.MatchString(variable) {
-		log.Fatalln(variable, "is not a valid Go identifier")
+	opts := gen.Options{
+		Inputs:          inputs,
+		Output:          output,
+		Variable:        *flagVariable,
+		BuildTags:       *flagBuild,
+		Include:         *flagInclude,
+		Exclude:         *flagExclude,
+		Gitignore:       *flagGitignore,
+		Quality:         *flagQuality,
+		Optional:        *flagOptional,
+		Eager:           *flagEager,
+		Lazy:            *flagLazy,
+		Async:           *flagAsync,
+		Defer:           *flagDefer,
+		SRI:             *flagSRI,
+		Encrypt:         *flagEncrypt,
+		CaseInsensitive: *flagNoCase,
+	}
+	if *verbose {
+		opts.Logger = log.New(os.Stderr, "broccoli: ", 0)
+	}
+
+	if *flagSign != "" {
+		key, err := readSigningKey(*flagSign)
+		if err != nil {
+			log.Fatalf("could not read the signing key: %v\n", err)
+		}
+		opts.Sign = key
 	}
 
-	includeGlob := *flagInclude
-	excludeGlob := *flagExclude
-	if includeGlob != "" && excludeGlob != "" {
-		log.Fatal("mutually exclusive options -include and -exclude found")
+	if *flagBundle == "" {
+		if _, err := gen.Generate(context.Background(), opts); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	quality := *flagQuality
-	if quality < 1 || quality > 11 {
-		log.Fatalf("unsupported compression level %d (1-11)\n", quality)
+	bundle, err := gen.Bundle(context.Background(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(*flagBundle, bundle, 0644)
+	if err != nil {
+		log.Fatalf("could not write to %s: %v\n", *flagBundle, err)
 	}
+}
 
-	g := Generator{
-		inputFiles:   inputs,
-		includeGlob:  includeGlob,
-		excludeGlob:  excludeGlob,
-		useGitignore: *flagGitignore,
-		quality:      quality,
+// diffPatch runs the diff-patch command, the flags
+// may be given before, after or between the bundles.
+func diffPatch(args []string) {
+	set := flag.NewFlagSet("diff-patch", flag.ExitOnError)
+	set.Usage = flag.Usage
+	output := set.String("o", "", "")
+	quality := set.Int("quality", *flagQuality, "")
+
+	var bundles []string
+	for {
+		set.Parse(args)
+		if set.NArg() == 0 {
+			break
+		}
+		bundles = append(bundles, set.Arg(0))
+		args = set.Args()[1:]
 	}
 
-	g.parsePackage()
+	if len(bundles) != 2 {
+		log.Fatal("diff-patch expects the old and the new bundles")
+	}
+	if *output == "" {
+		log.Fatal("diff-patch expects the output file, use -o")
+	}
+	if *quality < 1 || *quality > 11 {
+		log.Fatalf("unsupported compression level %d (1-11)\n", *quality)
+	}
 
-	bundle, err := g.generate()
+	old, err := ioutil.ReadFile(bundles[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	new, err := ioutil.ReadFile(bundles[1])
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	header := "// Code generated by broccoli at %v."
-	header = fmt.Sprintf(header, time.Now().Format(time.RFC3339))
+	patch, err := fs.Diff(old, new, *quality)
+	if err != nil {
+		log.Fatalf("could not diff the bundles: %v\n", err)
+	}
+	if *verbose {
+		log.Printf("patch is %d bytes, the new bundle is %d bytes\n", len(patch), len(new))
+	}
+
+	err = ioutil.WriteFile(*output, patch, 0644)
+	if err != nil {
+		log.Fatalf("could not write to %s: %v\n", *output, err)
+	}
+}
 
-	buildTags := *flagBuild
-	if buildTags != "" {
-		header = "// +build " + buildTags + "\n\n" + header
+// readSigningKey reads the PEM-encoded PKCS #8 ed25519 private key.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	code := fmt.Sprintf(template,
-		header, g.pkg.name, variable, *flagOptional, bundle)
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
 
-	err = ioutil.WriteFile(output, []byte(code), 0644)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		log.Fatalf("could not write to %s: %v\n", output, err)
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
 	}
+	return edKey, nil
 }
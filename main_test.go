@@ -1,31 +1,57 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/assert"
 
 	"aletheia.icu/broccoli/fs"
+	"aletheia.icu/broccoli/gen"
 )
 
 var (
-	bundle, _ = defaultGenerator().generate()
+	bundle, _ = gen.Bundle(context.Background(), defaultOptions())
 	br        = fs.New(false, bundle)
 )
 
-func defaultGenerator() *Generator {
-	return &Generator{
-		inputFiles: []string{"testdata"},
-		quality:    11,
+// openFile opens the named bundled file and unwraps the http.File.
+func openFile(br *fs.Broccoli, path string) (*fs.File, error) {
+	f, err := br.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.(*fs.File), nil
+}
+
+func defaultOptions() gen.Options {
+	return gen.Options{
+		Inputs:  []string{"testdata"},
+		Quality: 11,
 	}
 }
 
@@ -88,8 +114,8 @@ func TestBroccoli(t *testing.T) {
 }
 
 func TestGenerate(t *testing.T) {
-	walk := func(g *Generator, walkFn filepath.WalkFunc) {
-		bundle, err := g.generate()
+	walk := func(g gen.Options, walkFn filepath.WalkFunc) {
+		bundle, err := gen.Bundle(context.Background(), g)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -109,7 +135,7 @@ func TestGenerate(t *testing.T) {
 		return nil
 	})
 
-	g := defaultGenerator()
+	g := defaultOptions()
 	walk(g, func(path string, _ os.FileInfo, _ error) error {
 		virtualPaths = append(virtualPaths, path)
 		return nil
@@ -118,8 +144,8 @@ func TestGenerate(t *testing.T) {
 	// to be sure that generator without side-effects gives exactly the same file structure
 	assert.Equal(t, realPaths, virtualPaths, "paths asymmetric")
 
-	g = defaultGenerator()
-	g.includeGlob = "*.html"
+	g = defaultOptions()
+	g.Include = "*.html"
 	walk(g, func(path string, info os.FileInfo, _ error) error {
 		if !info.IsDir() && filepath.Ext(path) != ".html" {
 			t.Fatalf("generated bundle should not include excluded files")
@@ -127,8 +153,8 @@ func TestGenerate(t *testing.T) {
 		return nil
 	})
 
-	g = defaultGenerator()
-	g.excludeGlob = "*.html"
+	g = defaultOptions()
+	g.Exclude = "*.html"
 	walk(g, func(path string, info os.FileInfo, _ error) error {
 		if !info.IsDir() && filepath.Ext(path) == ".html" {
 			t.Fatalf("generated bundle should not include excluded files")
@@ -136,8 +162,8 @@ func TestGenerate(t *testing.T) {
 		return nil
 	})
 
-	g = defaultGenerator()
-	g.useGitignore = true
+	g = defaultOptions()
+	g.Gitignore = true
 	walk(g, func(path string, info os.FileInfo, _ error) error {
 		// following .gitignore rules
 		if info.IsDir() {
@@ -155,7 +181,7 @@ func TestFile(t *testing.T) {
 	_, err := fs.NewFile("bad")
 	assert.Error(t, err)
 
-	f, err := br.Open("testdata/index.html")
+	f, err := openFile(br, "testdata/index.html")
 	assert.NoError(t, err)
 
 	info, err := os.Stat("testdata/index.html")
@@ -184,17 +210,32 @@ func TestFile(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, n)
 
-	dir, err := br.Open("testdata/html")
+	dir, err := openFile(br, "testdata/html")
 	assert.NoError(t, err)
 
 	info, err = os.Stat("testdata/html")
 	assert.NoError(t, err)
 	assert.Equal(t, os.ModeDir, dir.Mode())
 	assert.Equal(t, info.ModTime().Truncate(time.Second), dir.ModTime())
+
+	// the dotfiles above the working directory keep their dots
+	tmp, err := ioutil.TempDir("", "broccoli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	assert.NoError(t, os.Mkdir(filepath.Join(tmp, "sub"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmp, ".env"), []byte("env"), 0644))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(filepath.Join(tmp, "sub")))
+	f, err = fs.NewFile("../.env")
+	assert.NoError(t, err)
+	assert.Equal(t, ".env", f.Fpath)
 }
 
 func TestFileSeek(t *testing.T) {
-	f, err := br.Open("testdata/index.html")
+	f, err := openFile(br, "testdata/index.html")
 	assert.NoError(t, err)
 
 	assert.NoError(t, f.Close())
@@ -249,10 +290,12 @@ func TestFileSeek(t *testing.T) {
 	t.Run("Seek(whence=io.SeekEnd)", func(t *testing.T) {
 		offset = size - chunkSize
 
-		_, err := f.Seek(size+1, io.SeekEnd)
+		_, err := f.Seek(1, io.SeekEnd)
+		assert.EqualError(t, err, "Seek: bad offset")
+		_, err = f.Seek(-size-1, io.SeekEnd)
 		assert.EqualError(t, err, "Seek: bad offset")
 
-		n, err := f.Seek(chunkSize, io.SeekEnd)
+		n, err := f.Seek(-chunkSize, io.SeekEnd)
 		assert.NoError(t, err)
 		assert.Equal(t, offset, n)
 
@@ -260,21 +303,30 @@ func TestFileSeek(t *testing.T) {
 		_, err = f.Read(b)
 		assert.Equal(t, data[offset:], b)
 	})
+
+	t.Run("Seek(EOF)", func(t *testing.T) {
+		n, err := f.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+		assert.Equal(t, size, n)
+		n, err = f.Seek(0, io.SeekCurrent)
+		assert.NoError(t, err)
+		assert.Equal(t, size, n)
+		_, err = f.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+
+		_, err = f.Seek(-1, io.SeekStart)
+		assert.EqualError(t, err, "Seek: bad offset")
+	})
 }
 
 func TestFileReaddir(t *testing.T) {
-	g := Generator{
-		inputFiles: []string{"testdata"},
-		quality:    11,
-	}
-
-	bundle, err := g.generate()
+	bundle, err := gen.Bundle(context.Background(), defaultOptions())
 	if err != nil {
 		t.Fatal(err)
 	}
 	br := fs.New(false, bundle)
 
-	dir, err := br.Open("testdata/readdir")
+	dir, err := openFile(br, "testdata/readdir")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -311,7 +363,7 @@ func TestFileReaddir(t *testing.T) {
 		assert.Error(t, err)
 	})
 
-	dir, _ = br.Open("testdata/readdir")
+	dir, _ = openFile(br, "testdata/readdir")
 	dir.Fpath = "bad"
 	_, err = dir.Readdir(1)
 	assert.Equal(t, io.EOF, err)
@@ -334,3 +386,1393 @@ func TestHttpFileServer(t *testing.T) {
 	assert.Equal(t, data, orig)
 	t.Log(string(data))
 }
+
+func TestServeSPA(t *testing.T) {
+	srv := httptest.NewServer(br.ServeSPA("testdata", "index.html",
+		fs.FallbackExclude("/api"), fs.AssetDirs("js")))
+	defer srv.Close()
+
+	orig, err := ioutil.ReadFile("testdata/index.html")
+	assert.NoError(t, err)
+
+	get := func(path, accept string) (int, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		assert.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := srv.Client().Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, data
+	}
+
+	const html = "text/html,application/xhtml+xml,*/*;q=0.8"
+
+	code, data := get("/settings/profile", html)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, orig, data)
+
+	code, _ = get("/js/googleJS.js", html)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get("/js/missing.js", html)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/js/missing", html)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/api/users", html)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/./api/users", html)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/x/../js/missing", html)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/settings/profile", "application/json")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// serve records the handler's response to a GET request.
+func serve(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestServeListing(t *testing.T) {
+	w := serve(br.Serve("testdata"), "/readdir/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<a href="1.txt">1.txt</a>`)
+
+	w = serve(br.Serve("testdata", fs.DirListing(fs.ListingOff)), "/readdir/")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, w.Body.String(), "1.txt")
+
+	w = serve(br.Serve("testdata", fs.DirListing(fs.ListingJSON)), "/readdir/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var entries []struct{ Name string }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "1.txt", entries[0].Name)
+
+	tmpl := htmltemplate.Must(htmltemplate.New("").Parse(
+		`{{.Path}}:{{range .Files}} {{.Name}}{{end}}`))
+	w = serve(br.Serve("testdata", fs.ListingTemplate(tmpl)), "/readdir/")
+	assert.Equal(t, "/readdir: 1.txt 2.txt 3.txt", w.Body.String())
+}
+
+func TestServeIndex(t *testing.T) {
+	orig, err := ioutil.ReadFile("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+
+	srv := br.Serve("testdata", fs.IndexFiles("index.htm", "goDraw.html"))
+	w := serve(srv, "/html/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, orig, w.Body.Bytes())
+
+	w = serve(srv, "/html")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "html/", w.Header().Get("Location"))
+	w = serve(srv, "/html/goDraw.html")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "./", w.Header().Get("Location"))
+	w = serve(srv, "/index.html/")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "../index.html", w.Header().Get("Location"))
+
+	srv = br.Serve("testdata", fs.IndexFiles("goDraw.html"), fs.RedirectSlash(false))
+	w = serve(srv, "/html")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, orig, w.Body.Bytes())
+	w = serve(srv, "/html/goDraw.html")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServeErrors(t *testing.T) {
+	orig, err := ioutil.ReadFile("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+
+	w := serve(br.Serve("testdata", fs.ErrorPage(404, "html/goDraw.html")), "/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, orig, w.Body.Bytes())
+
+	var (
+		misses []string
+		status int
+	)
+	logger := func(w http.ResponseWriter, r *http.Request, code int, err error) {
+		misses = append(misses, r.URL.Path)
+		status = code
+		assert.True(t, os.IsNotExist(err))
+	}
+	srv := br.Serve("testdata", fs.ErrorPage(404, "html/goDraw.html"), fs.OnError(logger))
+	w = serve(srv, "/missing")
+	assert.Equal(t, []string{"/missing"}, misses)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, orig, w.Body.Bytes())
+
+	w = serve(br.Serve("testdata", fs.OnError(func(w http.ResponseWriter, _ *http.Request, code int, _ error) {
+		w.WriteHeader(http.StatusTeapot)
+	})), "/missing")
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = serve(br.Serve("testdata", fs.ErrorPage(404, "missing.html")), "/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "404 page not found\n", w.Body.String())
+}
+
+// bundleWith bundles testdata along with the extra files.
+func bundleWith(t *testing.T, extra map[string]string) *fs.Broccoli {
+	return fs.New(false, packWith(t, extra))
+}
+
+// packWith packs the testdata along with the extra files.
+func packWith(t *testing.T, extra map[string]string) []byte {
+	var files []*fs.File
+	filepath.Walk("testdata", func(path string, info os.FileInfo, _ error) error {
+		f, err := fs.NewFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, f)
+		return nil
+	})
+
+	for path, data := range extra {
+		files = append(files, &fs.File{
+			Data:  []byte(data),
+			Fpath: path,
+			Fname: filepath.Base(path),
+			Fsize: int64(len(data)),
+			Ftime: time.Now().Unix(),
+		})
+	}
+
+	bundle, err := fs.Pack(files, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bundle
+}
+
+func TestServeHeaders(t *testing.T) {
+	br := bundleWith(t, map[string]string{
+		"testdata/_headers": `# caching policy
+/js/*
+  Cache-Control: public, max-age=31536000
+  X-Content-Type-Options: nosniff
+/index.html
+  Cache-Control: no-cache
+`,
+	})
+
+	srv := br.Serve("testdata", fs.Headers("/html/:page", http.Header{
+		"Content-Security-Policy": {"default-src 'self'"},
+	}), fs.Headers("/js/googleJS.js", http.Header{
+		"Cache-Control": {"no-store"},
+	}))
+
+	w := serve(srv, "/js/youtubescript/webcomponents.js")
+	assert.Equal(t, "public, max-age=31536000", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	w = serve(srv, "/js/googleJS.js")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	w = serve(srv, "/")
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	w = serve(srv, "/html/goDraw.html")
+	assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+
+	w = serve(srv, "/js/missing.js")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+	w = serve(srv, "/_headers")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// the rules of the index document apply to the fallback
+	spa := br.ServeSPA("testdata", "index.html")
+	req := httptest.NewRequest("GET", "/settings/profile", nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	spa.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	// the dot segments don't dodge the rules
+	w = serve(srv, "/./js/youtubescript/webcomponents.js")
+	assert.Equal(t, "public, max-age=31536000", w.Header().Get("Cache-Control"))
+	w = serve(srv, "/x/../js/googleJS.js")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	w = serve(srv, "/html/./goDraw.html")
+	assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+
+	// nor are the configuration files listed
+	w = serve(br.Serve("testdata", fs.IndexFiles()), "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "index.html")
+	assert.NotContains(t, w.Body.String(), "_headers")
+	w = serve(br.Serve("testdata", fs.IndexFiles(), fs.DirListing(fs.ListingJSON)), "/")
+	assert.NotContains(t, w.Body.String(), "_headers")
+
+	_, err := br.NewServer("testdata", fs.Headers("static/*", nil))
+	assert.EqualError(t, err, `pattern "static/*" must start with /`)
+
+	br = bundleWith(t, map[string]string{"testdata/_headers": "  Cache-Control: no-cache\n"})
+	_, err = br.NewServer("testdata")
+	assert.EqualError(t, err, "testdata/_headers:1: header without a path")
+	assert.Panics(t, func() { br.Serve("testdata") })
+}
+
+func TestServeRedirects(t *testing.T) {
+	br := bundleWith(t, map[string]string{
+		"testdata/_redirects": `# renamed pages
+/old.html       /index.html
+/scripts/*      /js/:splat         302
+/pages/:page    /html/:page.html   200
+/readdir/*      /index.html        307!
+`,
+	})
+
+	srv := br.Serve("testdata", fs.Redirects(
+		fs.RedirectRule{From: "/docs/*", To: "/html/goDraw.html", Status: 200},
+		fs.RedirectRule{From: "/old.html", To: "/html/", Status: 308},
+		fs.RedirectRule{From: "/index.html", To: "/html/", Status: 308},
+	))
+
+	w := serve(srv, "/old.html?q=1")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/index.html?q=1", w.Header().Get("Location"))
+	w = serve(srv, "/scripts/youtubescript/webcomponents.js")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/js/youtubescript/webcomponents.js", w.Header().Get("Location"))
+	w = serve(srv, "/readdir/1.txt")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	w = serve(srv, "/index.html")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "./", w.Header().Get("Location"))
+
+	orig, err := ioutil.ReadFile("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+	w = serve(srv, "/pages/goDraw")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, orig, w.Body.Bytes())
+	w = serve(srv, "/docs/a/b/c")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, orig, w.Body.Bytes())
+	w = serve(srv, "/pages/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(srv, "/_redirects")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	errs := map[fs.RedirectRule]string{
+		{From: "/a", To: "/b", Status: 404}:         "redirect /a: unsupported status 404",
+		{From: "/a/:id", To: "/b/:ib", Status: 301}: "redirect /a/:id: placeholder :ib is not defined",
+		{From: "/a", To: "/b/:splat", Status: 301}:  "redirect /a: :splat used without *",
+		{From: "/a", To: "https://x", Status: 200}:  `rewrite /a: target "https://x" must be a local path`,
+		{From: "/*/a", To: "/b", Status: 301}:       `pattern "/*/a": * must be the last segment`,
+	}
+	for rule, msg := range errs {
+		_, err := br.NewServer("testdata", fs.Redirects(rule))
+		assert.EqualError(t, err, msg)
+	}
+
+	br = bundleWith(t, map[string]string{"testdata/_redirects": "/a /b 301\n/c /d 30x\n"})
+	_, err = br.NewServer("testdata")
+	assert.EqualError(t, err, `testdata/_redirects:2: malformed status "30x"`)
+}
+
+type testObserver struct {
+	opens, misses []string
+	decompressed  []string
+	responses     []string
+}
+
+func (o *testObserver) Open(path string, hit bool) {
+	if hit {
+		o.opens = append(o.opens, path)
+	} else {
+		o.misses = append(o.misses, path)
+	}
+}
+
+func (o *testObserver) Decompress(path string, _ time.Duration, compressed, decompressed int) {
+	o.decompressed = append(o.decompressed, path)
+}
+
+func (o *testObserver) Response(path string, status int, encoding string) {
+	o.responses = append(o.responses, fmt.Sprintf("%s %d %s", path, status, encoding))
+}
+
+func TestObserver(t *testing.T) {
+	br := fs.New(true, bundle)
+	o := &testObserver{}
+	br.Observe(o)
+
+	_, err := br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/missing")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"testdata/index.html", "testdata/index.html"}, o.opens)
+	assert.Equal(t, []string{"testdata/missing"}, o.misses)
+	assert.Equal(t, []string{"testdata/index.html"}, o.decompressed)
+
+	srv := br.Serve("testdata")
+	serve(srv, "/index.html/")
+	serve(srv, "/html/goDraw.html")
+	serve(srv, "/missing")
+	assert.Equal(t, []string{
+		"/index.html/ 301 identity",
+		"/html/goDraw.html 200 identity",
+		"/missing 404 identity",
+	}, o.responses)
+
+	ev := fs.NewExpvarObserver("broccoli_test")
+	br.Observe(ev)
+	serve(srv, "/html/goDraw.html")
+	serve(srv, "/missing")
+	assert.Equal(t, "1", ev.Get("open.hit").String())
+	assert.Equal(t, "1", ev.Get("open.miss").String())
+	assert.Equal(t, "1", ev.Get("response.status.404").String())
+	assert.Equal(t, "2", ev.Get("response.encoding.identity").String())
+	assert.Nil(t, ev.Get("decompress.count"))
+}
+
+func TestCacheLimit(t *testing.T) {
+	br := fs.New(true, bundle)
+
+	index, err := ioutil.ReadFile("testdata/index.html")
+	assert.NoError(t, err)
+	br.SetCacheLimit(int64(len(index)))
+
+	f, err := br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+
+	stats := br.CacheStats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Evictions)
+	assert.Equal(t, int64(0), stats.Size)
+
+	// the handle must outlive the eviction
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, index, data)
+
+	br.SetCacheLimit(0)
+	assert.NoError(t, br.Pin("testdata/index.html"))
+	assert.Error(t, br.Pin("testdata/missing"))
+	br.SetCacheLimit(int64(len(index)))
+	_, err = br.Open("testdata/js/googleJS.js")
+	assert.NoError(t, err)
+
+	stats = br.CacheStats()
+	assert.Equal(t, uint64(4), stats.Misses)
+	assert.Equal(t, uint64(3), stats.Evictions)
+	assert.Equal(t, int64(len(index)), stats.Size)
+
+	_, err = br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), br.CacheStats().Hits)
+
+	br.Unpin("testdata/index.html")
+	br.SetCacheLimit(1)
+	assert.Equal(t, int64(0), br.CacheStats().Size)
+}
+
+func TestEagerLazy(t *testing.T) {
+	g := defaultOptions()
+	g.Quality = 1
+	g.Package = "main"
+	g.Eager = "*.html"
+	code, err := gen.Generate(context.Background(), g)
+	assert.NoError(t, err)
+	assert.Contains(t, string(code), "var br = fs.New(true, ")
+
+	bundle, err := gen.Bundle(context.Background(), g)
+	assert.NoError(t, err)
+
+	br := fs.New(true, bundle)
+	_, err = br.Open("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/js/googleJS.js")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), br.CacheStats().Misses)
+
+	// eager tells whether if the file is marked for decompression at startup.
+	eager := func(g gen.Options, name string) (eager bool) {
+		bundle, err := gen.Bundle(context.Background(), g)
+		assert.NoError(t, err)
+		repack(t, bundle, func(files []*fs.File) []*fs.File {
+			for _, f := range files {
+				if f.Fname == name {
+					eager = f.Eager
+				}
+			}
+			return files
+		})
+		return
+	}
+
+	g = defaultOptions()
+	g.Quality = 1
+	assert.False(t, eager(g, "index.html"))
+	g.Lazy = "*.js"
+	assert.True(t, eager(g, "index.html"))
+	assert.False(t, eager(g, "googleJS.js"))
+	g.Eager = "*.html"
+	g.Optional = true
+	assert.True(t, eager(g, "index.html"))
+	assert.False(t, eager(g, "1.txt"))
+}
+
+func TestPreload(t *testing.T) {
+	br := fs.New(true, bundle)
+	assert.NoError(t, br.Preload("testdata/*.html", "testdata/html/*"))
+	assert.Equal(t, uint64(2), br.CacheStats().Misses)
+
+	_, err := br.Open("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), br.CacheStats().Hits)
+
+	assert.Error(t, br.Preload("testdata/[")) // bad pattern
+	assert.NoError(t, br.Preload("nothing/*"))
+}
+
+func TestNewAsync(t *testing.T) {
+	br := fs.NewAsync(false, bundle)
+
+	f, err := openFile(br, "testdata/html/goDraw.html")
+	assert.NoError(t, err)
+	orig, err := ioutil.ReadFile("testdata/html/goDraw.html")
+	assert.NoError(t, err)
+	assert.Equal(t, orig, f.Data)
+
+	select {
+	case <-br.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("background decompression timed out")
+	}
+	assert.Equal(t, fs.CacheStats{}, br.CacheStats())
+
+	br = fs.New(false, bundle)
+	select {
+	case <-br.Ready():
+	default:
+		t.Fatal("New must be ready on return")
+	}
+}
+
+func TestNewLazy(t *testing.T) {
+	br := fs.NewLazy(false, nil)
+	br.Development(true) // must not decode the bundle
+	_, err := br.Stat("testdata/index.html")
+	assert.NoError(t, err)
+
+	br = fs.NewLazy(false, bundle)
+	_, err = br.Stat("testdata/index.html")
+	assert.NoError(t, err)
+
+	br = fs.NewLazy(true, bundle)
+	_, err = br.Open("testdata/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), br.CacheStats().Misses)
+
+	// the settings made before the first use hold
+	br = fs.NewLazy(true, bundle)
+	br.CaseInsensitive(true)
+	_, err = br.Stat("TestData/Index.HTML")
+	assert.NoError(t, err)
+
+	br = fs.NewLazy(false, nil)
+	assert.Panics(t, func() {
+		br.Open("testdata/index.html")
+	}, "NewLazy must panic on the first use with empty bundle")
+	assert.Panics(t, func() {
+		br.Open("testdata/index.html")
+	}, "NewLazy must panic on every use once failed")
+	assert.Panics(t, func() { br.Ready() })
+}
+
+func TestVerify(t *testing.T) {
+	br := fs.New(true, bundle)
+	assert.NoError(t, br.Verify())
+
+	// the checksums of another contents
+	bad := bytes.Repeat([]byte{1}, sha256.Size)
+	files := []*fs.File{
+		{Data: []byte("good"), Fpath: "good.txt", Fname: "good.txt", Fsize: 4, Ftime: 1},
+		{Data: []byte("bad"), Fpath: "bad.txt", Fname: "bad.txt", Fsize: 3, Ftime: 1, Fhash: bad},
+		{Data: []byte("worse"), Fpath: "worse.txt", Fname: "worse.txt", Fsize: 5, Ftime: 1, Fhash: bad},
+	}
+	b, err := fs.Pack(files, 1)
+	assert.NoError(t, err)
+
+	br = fs.New(true, b)
+	err = br.Verify()
+	assert.EqualError(t, err, "checksum mismatch: bad.txt, worse.txt")
+	var ierr *fs.IntegrityError
+	assert.True(t, errors.As(err, &ierr))
+	assert.Equal(t, []string{"bad.txt", "worse.txt"}, ierr.Paths)
+
+	_, err = br.Open("bad.txt")
+	assert.NoError(t, err, "verification is disabled by default")
+
+	br.SetVerify(fs.VerifyOnce)
+	_, err = br.Open("good.txt")
+	assert.NoError(t, err)
+	_, err = br.Open("bad.txt")
+	assert.EqualError(t, err, "checksum mismatch: bad.txt")
+	_, err = br.Open("bad.txt")
+	assert.Error(t, err, "mismatched files are never verified")
+}
+
+func TestIntegrity(t *testing.T) {
+	g := defaultOptions()
+	g.Quality = 1
+	g.SRI = "sha384"
+	bundle, err := gen.Bundle(context.Background(), g)
+	assert.NoError(t, err)
+	br := fs.New(true, bundle)
+
+	data, err := ioutil.ReadFile("testdata/js/googleJS.js")
+	assert.NoError(t, err)
+	sum := sha512.Sum384(data)
+	digest := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	sri, err := br.Integrity("testdata/js/googleJS.js")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, sri)
+	_, err = br.Integrity("testdata/missing.js")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	tmpl := htmltemplate.Must(htmltemplate.New("").Funcs(br.FuncMap("testdata")).Parse(
+		`{{sri "/js/googleJS.js"}}|{{integrity "/js/googleJS.js"}}`))
+	var b strings.Builder
+	assert.NoError(t, tmpl.Execute(&b, nil))
+	assert.Equal(t, `<script src="/js/googleJS.js" integrity="`+digest+
+		`" crossorigin="anonymous"></script>|`+digest, b.String())
+
+	sri, err = fs.SRIDigest("sha256", []byte("alert('Hello, world.');"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256-qznLcsROx4GACP2dm0UCKCzCG+HiZ1guq6ZZDob/Tng=", sri)
+	_, err = fs.SRIDigest("md5", nil)
+	assert.Error(t, err)
+
+	_, err = bundleWith(t, nil).Integrity("testdata/index.html")
+	assert.EqualError(t, err, "no integrity digest for testdata/index.html")
+
+	br.Development(true)
+	sri, err = br.Integrity("testdata/js/googleJS.js")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, sri)
+}
+
+func TestSignedBundle(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "broccoli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	assert.NoError(t, err)
+
+	key, err = readSigningKey(keyFile)
+	assert.NoError(t, err)
+	signed := fs.Sign(bundle, key)
+
+	br, err := fs.NewVerified(signed, pub)
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/index.html")
+	assert.NoError(t, err)
+
+	// signature is transparent to the older constructors
+	_, err = fs.New(false, signed).Open("testdata/index.html")
+	assert.NoError(t, err)
+
+	_, err = fs.NewVerified(bundle, pub)
+	assert.Equal(t, fs.ErrUnsigned, err)
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	_, err = fs.NewVerified(signed, other)
+	assert.Equal(t, fs.ErrBadSignature, err)
+
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = fs.NewVerified(tampered, pub)
+	assert.Equal(t, fs.ErrBadSignature, err)
+}
+
+func TestEncryptedBundle(t *testing.T) {
+	os.Setenv("BROCCOLI_TEST_KEY", strings.Repeat("ab", 32))
+	defer os.Unsetenv("BROCCOLI_TEST_KEY")
+
+	g := defaultOptions()
+	g.Quality = 1
+	g.Package = "main"
+	g.Encrypt = "env:BROCCOLI_TEST_KEY"
+	code, err := gen.Generate(context.Background(), g)
+	assert.NoError(t, err)
+	assert.Contains(t, string(code), `fs.KeyFromEnv("BROCCOLI_TEST_KEY")`)
+
+	bundle, err := gen.Bundle(context.Background(), g)
+	assert.NoError(t, err)
+
+	g.Encrypt = "BROCCOLI_TEST_KEY"
+	_, err = gen.Bundle(context.Background(), g)
+	var optErr *gen.OptionError
+	assert.True(t, errors.As(err, &optErr))
+	assert.Equal(t, "Encrypt", optErr.Option)
+
+	orig, err := ioutil.ReadFile("testdata/index.html")
+	assert.NoError(t, err)
+
+	br := fs.NewWithKey(bundle, fs.KeyFromEnv("BROCCOLI_TEST_KEY"))
+	f, err := openFile(br, "testdata/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, orig, f.Data)
+	br.SetVerify(fs.VerifyAlways)
+	assert.NoError(t, br.Verify())
+
+	_, err = fs.New(false, bundle).Open("testdata/index.html")
+	assert.True(t, errors.Is(err, fs.ErrNoKey))
+
+	wrong := func() ([]byte, error) { return fs.ParseKey(strings.Repeat("cd", 32)) }
+	_, err = fs.NewWithKey(bundle, wrong).Open("testdata/index.html")
+	assert.True(t, errors.Is(err, fs.ErrWrongKey))
+
+	_, err = fs.ParseKey("abcd")
+	assert.EqualError(t, err, "bad key length 2, must be 16, 24 or 32 bytes")
+}
+
+// repack decodes the files of the bundle, passes them
+// through fn and encodes them back, without the footer.
+func repack(t testing.TB, bundle []byte, fn func([]*fs.File) []*fs.File) []byte {
+	var files []*fs.File
+	header, payload := bundle[:5], bundle[5:]
+	err := gob.NewDecoder(brotli.NewReader(bytes.NewReader(payload))).Decode(&files)
+	assert.NoError(t, err)
+
+	b := bytes.NewBuffer(append([]byte{}, header...))
+	w := brotli.NewWriterLevel(b, 1)
+	assert.NoError(t, gob.NewEncoder(w).Encode(fn(files)))
+	assert.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestLoad(t *testing.T) {
+	g := defaultOptions()
+	g.Quality = 1
+	bundle, err := gen.Bundle(context.Background(), g)
+	assert.NoError(t, err)
+
+	br, err := fs.Load(bundle, fs.LoadOptions{Verify: true})
+	assert.NoError(t, err)
+	_, err = openFile(br, "testdata/index.html")
+	assert.NoError(t, err)
+
+	// the bundles generated by the older versions have no header
+	br, err = fs.Load(bundle[5:], fs.LoadOptions{Optional: true})
+	assert.NoError(t, err)
+	_, err = openFile(br, "testdata/index.html")
+	assert.NoError(t, err)
+
+	newer := append([]byte{}, bundle...)
+	newer[4] = 255
+	_, err = fs.Load(newer, fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrUnsupportedVersion))
+	assert.EqualError(t, err, "version 255: unsupported bundle version")
+
+	_, err = fs.Load(bundle[:len(bundle)/2], fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+
+	dup := repack(t, bundle, func(files []*fs.File) []*fs.File {
+		return append(files, files[0])
+	})
+	_, err = fs.Load(dup, fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+
+	// the paths must be canonical, else they can't be looked up
+	for _, name := range []string{"/x", "x/", "a/../b", "a//b", "./a", `a\b`, "a\x00b", ".."} {
+		bad := repack(t, bundle, func(files []*fs.File) []*fs.File {
+			return append(files, &fs.File{Fpath: name, Fname: "b", Ftime: 1})
+		})
+		_, err = fs.Load(bad, fs.LoadOptions{Optional: true})
+		assert.True(t, errors.Is(err, fs.ErrCorrupt), name)
+	}
+
+	bomb := repack(t, bundle, func(files []*fs.File) []*fs.File {
+		for _, f := range files {
+			if f.Fpath == "testdata/index.html" {
+				f.Fsize = 1
+			}
+		}
+		return files
+	})
+	br, err = fs.Load(bomb, fs.LoadOptions{Optional: true})
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/index.html")
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+	_, err = fs.Load(bomb, fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+
+	// the sizes are enforced for the headerless bundles, too
+	br, err = fs.Load(bomb[5:], fs.LoadOptions{Optional: true})
+	assert.NoError(t, err)
+	_, err = br.Open("testdata/index.html")
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+	_, err = fs.Load(bomb[5:], fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+
+	// corrupted bundles must never panic
+	for i := 0; i < len(bundle); i += len(bundle)/500 + 1 {
+		b := append([]byte{}, bundle...)
+		b[i] ^= 0x55
+
+		br, err := fs.Load(b, fs.LoadOptions{Optional: true})
+		if err != nil {
+			continue
+		}
+		br.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+			if f, err := br.Open(path); err == nil {
+				ioutil.ReadAll(f)
+			}
+			return nil
+		})
+	}
+}
+
+func TestPatch(t *testing.T) {
+	var text strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&text, "line %d\n", i)
+	}
+	changed := strings.Replace(text.String(), "line 500\n", "line five hundred\n", 1)
+
+	old := packWith(t, map[string]string{
+		"a.txt":    text.String(),
+		"b.txt":    "bee",
+		"gone.txt": "gone",
+	})
+	new := packWith(t, map[string]string{
+		"a.txt":       changed,
+		"renamed.txt": "bee",
+		"new.txt":     "new",
+	})
+
+	patch, err := fs.Diff(old, new, 5)
+	assert.NoError(t, err)
+	assert.Less(t, len(patch), len(new)/10)
+
+	bundle, err := fs.Patch(old, patch)
+	assert.NoError(t, err)
+	br, err := fs.Load(bundle, fs.LoadOptions{Verify: true})
+	assert.NoError(t, err)
+
+	for path, data := range map[string]string{
+		"a.txt":       changed,
+		"renamed.txt": "bee",
+		"new.txt":     "new",
+	} {
+		f, err := openFile(br, path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(f.Data))
+	}
+	for _, path := range []string{"b.txt", "gone.txt"} {
+		_, err = br.Open(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = openFile(br, "testdata/index.html")
+	assert.NoError(t, err)
+
+	br, err = fs.New(false, old).Patch(patch)
+	assert.NoError(t, err)
+	f, err := openFile(br, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, changed, string(f.Data))
+
+	_, err = fs.Patch(new, patch)
+	assert.Equal(t, fs.ErrPatchMismatch, err)
+
+	_, err = fs.Patch(old, patch[:len(patch)/2])
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+}
+func TestReplace(t *testing.T) {
+	br := bundleWith(t, map[string]string{"v.txt": "one"})
+	br.SetVerify(fs.VerifyAlways)
+	h := br.Serve("")
+
+	var replaced int
+	br.OnReplace(func() { replaced++ })
+
+	old, err := br.Open("v.txt")
+	assert.NoError(t, err)
+
+	next, err := fs.Load(packWith(t, map[string]string{
+		"v.txt":   "two",
+		"new.txt": "new",
+	}), fs.LoadOptions{Optional: true})
+	assert.NoError(t, err)
+
+	// the readers must never see a mix of the versions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			f, err := openFile(br, "v.txt")
+			assert.NoError(t, err)
+			assert.Contains(t, []string{"one", "two"}, string(f.Data))
+		}
+	}()
+	assert.NoError(t, br.Replace(next))
+	<-done
+
+	assert.Equal(t, 1, replaced)
+	data, err := ioutil.ReadAll(old)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+
+	f, err := openFile(br, "v.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(f.Data))
+	assert.Equal(t, http.StatusOK, serve(h, "/new.txt").Code)
+	assert.NotZero(t, br.CacheStats().Misses, "the stats of the new version")
+}
+
+func TestOverlay(t *testing.T) {
+	br := bundleWith(t, nil)
+	h := br.Serve("testdata")
+
+	assert.NoError(t, br.WriteFile("testdata/config.js", []byte("cfg")))
+	assert.NoError(t, br.WriteFile("testdata/index.html", []byte("shadow")))
+	rec := serve(h, "/config.js")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cfg", rec.Body.String())
+	assert.Equal(t, "shadow", serve(h, "/").Body.String())
+
+	info, err := br.Stat("testdata/config.js")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), info.Size())
+
+	err = br.WriteFile("missing/config.js", nil)
+	assert.True(t, os.IsNotExist(err))
+	err = br.Mkdir("testdata/js")
+	assert.True(t, os.IsExist(err))
+
+	assert.NoError(t, br.Mkdir("testdata/gen"))
+	w, err := br.Create("testdata/gen/sitemap.xml")
+	assert.NoError(t, err)
+	fmt.Fprint(w, "<urlset/>")
+	assert.NoError(t, w.Close())
+
+	dir, err := br.Open("testdata/gen")
+	assert.NoError(t, err)
+	infos, err := dir.Readdir(0)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "sitemap.xml", infos[0].Name())
+	assert.Equal(t, "<urlset/>", serve(h, "/gen/sitemap.xml").Body.String())
+
+	assert.Error(t, br.Remove("testdata/gen"), "directory not empty")
+	assert.NoError(t, br.Remove("testdata/index.html"))
+	_, err = br.Open("testdata/index.html")
+	assert.True(t, os.IsNotExist(err))
+
+	var paths []string
+	br.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return nil
+	})
+	assert.Contains(t, paths, "testdata/config.js")
+	assert.Contains(t, paths, "testdata/gen/sitemap.xml")
+	assert.NotContains(t, paths, "testdata/index.html")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			br.WriteFile("testdata/config.js", []byte(fmt.Sprint(i)))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, http.StatusOK, serve(h, "/config.js").Code)
+	}
+	<-done
+}
+
+func TestPathResolution(t *testing.T) {
+	dev := fs.New(false, bundle)
+	dev.Development(true)
+
+	for _, br := range []*fs.Broccoli{br, dev} {
+		for _, name := range []string{
+			"testdata/index.html",
+			"/testdata/index.html",
+			"//testdata/index.html",
+			"./testdata/index.html",
+			"testdata/js/../index.html",
+			`testdata\index.html`,
+			`\testdata\js\..\index.html`,
+		} {
+			_, err := br.Stat(name)
+			assert.NoError(t, err, name)
+		}
+
+		for _, name := range []string{"testdata", "./testdata/", "testdata//"} {
+			info, err := br.Stat(name)
+			assert.NoError(t, err, name)
+			assert.True(t, info.IsDir(), name)
+		}
+
+		for _, name := range []string{
+			"..",
+			"../main.go",
+			"/../main.go",
+			"testdata/../../main.go",
+			`..\main.go`,
+			`testdata\..\..\main.go`,
+			"testdata/\x00",
+		} {
+			_, err := br.Open(name)
+			assert.True(t, errors.Is(err, os.ErrInvalid), name)
+			_, err = br.Stat(name)
+			assert.True(t, errors.Is(err, os.ErrInvalid), name)
+		}
+	}
+}
+
+func TestServeTraversal(t *testing.T) {
+	dev := fs.New(false, bundle)
+	dev.Development(true)
+
+	for _, br := range []*fs.Broccoli{br, dev} {
+		h := br.Serve("testdata/js")
+
+		for _, target := range []string{
+			"/../index.html",
+			"/../../main.go",
+			"/..%2f..%2fmain.go",
+			"/%2e%2e/%2e%2e/main.go",
+			"/.%2e/.%2e/main.go",
+			`/..\..\main.go`,
+			"/..%5c..%5cmain.go",
+			"/x/..%5c..%5c..%5cmain.go",
+			"//../../main.go",
+			"/%00/../../main.go",
+			"/C:/Windows/win.ini",
+			"/c:%5cWindows%5cwin.ini",
+		} {
+			rec := serve(h, target)
+			assert.NotEqual(t, http.StatusOK, rec.Code, target)
+			assert.NotContains(t, rec.Body.String(), "package main", target)
+			assert.NotContains(t, rec.Body.String(), "<html", target)
+		}
+
+		srv, err := br.NewServer("testdata/js")
+		assert.NoError(t, err)
+		_, err = srv.Open("../index.html")
+		assert.True(t, errors.Is(err, os.ErrInvalid))
+		if runtime.GOOS == "windows" {
+			_, err = br.Open("C:/Windows/win.ini")
+			assert.True(t, errors.Is(err, os.ErrInvalid))
+		}
+		assert.Equal(t, http.StatusBadRequest, serve(h, `/..\index.html`).Code)
+		assert.Equal(t, http.StatusOK, serve(h, "/googleJS.js").Code)
+	}
+
+	// the colons are only rejected in the volume names
+	colon, err := fs.FromMap(map[string][]byte{"10:30.txt": []byte("x")})
+	assert.NoError(t, err)
+	_, err = colon.Open("10:30.txt")
+	assert.NoError(t, err)
+
+	// nor do the backslashes dodge the configuration files or the prefixes
+	cfg := bundleWith(t, map[string]string{
+		"testdata/_headers":   "/secret\n  X-Secret: headers\n",
+		"testdata/_redirects": "/secret /index.html 301\n",
+	})
+	spa := cfg.ServeSPA("testdata", "index.html", fs.FallbackExclude("/api"), fs.AssetDirs("/js"))
+	for _, target := range []string{"/%5C_headers", "/%5C_redirects", "/x/..%5C_headers"} {
+		rec := serve(spa, target)
+		assert.NotEqual(t, http.StatusOK, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), "/secret", target)
+	}
+	for _, target := range []string{"/api%5Cusers", "/js%5Cmissing"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "text/html")
+		rec := httptest.NewRecorder()
+		spa.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+	}
+}
+
+func TestParents(t *testing.T) {
+	files := []*fs.File{
+		{Data: []byte("c"), Fpath: "a/b/c.txt", Fname: "c.txt", Fsize: 1, Ftime: 200},
+		{Data: []byte("x"), Fpath: "x.txt", Fname: "x.txt", Fsize: 1, Ftime: 100},
+	}
+	b, err := fs.Pack(files, 1)
+	assert.NoError(t, err)
+	br, err := fs.Load(b, fs.LoadOptions{Verify: true})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"/", ".", "a", "a/b"} {
+		info, err := br.Stat(name)
+		assert.NoError(t, err, name)
+		assert.True(t, info.IsDir(), name)
+		assert.Equal(t, int64(200), info.ModTime().Unix(), name)
+	}
+
+	root, err := br.Open("/")
+	assert.NoError(t, err)
+	infos, err := root.Readdir(-1)
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.Equal(t, []string{"a", "x.txt"}, names)
+
+	var paths []string
+	br.Walk(".", func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return nil
+	})
+	assert.Equal(t, []string{".", "a", "a/b", "a/b/c.txt", "x.txt"}, paths)
+
+	rec := serve(http.FileServer(br), "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<a href="x.txt">x.txt</a>`)
+
+	// the absolute paths have no parents to synthesize
+	b, err = fs.Pack([]*fs.File{{Data: []byte("x"), Fpath: "/etc/x", Fname: "x", Fsize: 1}}, 1)
+	assert.NoError(t, err)
+	_, err = fs.Load(b, fs.LoadOptions{})
+	assert.True(t, errors.Is(err, fs.ErrCorrupt))
+
+	// only the direct entries are listed
+	dir, err := bundleWith(t, nil).Open("testdata")
+	assert.NoError(t, err)
+	infos, err = dir.Readdir(-1)
+	assert.NoError(t, err)
+	for _, info := range infos {
+		assert.NotContains(t, info.Name(), "/")
+		assert.NotEqual(t, "googleJS.js", info.Name())
+	}
+}
+
+func TestSub(t *testing.T) {
+	dev := fs.New(false, bundle)
+	dev.Development(true)
+
+	for _, br := range []*fs.Broccoli{bundleWith(t, nil), dev} {
+		sub, err := br.Sub("testdata")
+		assert.NoError(t, err)
+
+		for _, name := range []string{"index.html", "/index.html", "js/../index.html"} {
+			_, err = sub.Stat(name)
+			assert.NoError(t, err, name)
+		}
+		for _, name := range []string{"../main.go", "../testdata/index.html", `..\main.go`} {
+			_, err = sub.Open(name)
+			assert.True(t, errors.Is(err, os.ErrInvalid), name)
+		}
+
+		var paths []string
+		sub.Walk(".", func(path string, info os.FileInfo, err error) error {
+			paths = append(paths, path)
+			return nil
+		})
+		assert.Equal(t, ".", paths[0])
+		assert.Contains(t, paths, "js/googleJS.js")
+		for _, path := range paths {
+			assert.False(t, strings.HasPrefix(path, "testdata"), path)
+		}
+
+		js, err := sub.Sub("js")
+		assert.NoError(t, err)
+		_, err = js.Stat("googleJS.js")
+		assert.NoError(t, err)
+
+		h := sub.Serve("")
+		assert.Equal(t, http.StatusOK, serve(h, "/js/googleJS.js").Code)
+		assert.NotEqual(t, http.StatusOK, serve(h, "/..%2fmain.go").Code)
+	}
+
+	br := bundleWith(t, nil)
+	sub, err := br.Sub("testdata")
+	assert.NoError(t, err)
+
+	root, err := sub.Open("/")
+	assert.NoError(t, err)
+	infos, err := root.Readdir(-1)
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.Contains(t, names, "index.html")
+
+	assert.NoError(t, sub.WriteFile("config.js", []byte("cfg")))
+	_, err = br.Stat("testdata/config.js")
+	assert.NoError(t, err)
+
+	_, err = br.Sub("missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = br.Sub("testdata/index.html")
+	assert.Error(t, err)
+	assert.Error(t, sub.Replace(br))
+	_, err = sub.Patch(nil)
+	assert.Error(t, err)
+}
+
+func TestGlob(t *testing.T) {
+	dev := fs.New(false, bundle)
+	dev.Development(true)
+
+	for _, br := range []*fs.Broccoli{bundleWith(t, nil), dev} {
+		matches, err := br.Glob("testdata/*.html")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"testdata/index.html"}, matches)
+
+		matches, err = br.Glob("testdata/**/*.js")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"testdata/js/googleJS.js",
+			"testdata/js/youtubescript/contents/youtube.js",
+			"testdata/js/youtubescript/webcomponents.js",
+		}, matches)
+
+		matches, err = br.Glob("/testdata/{html,readdir}/{goDraw.html,[12].txt}")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"testdata/html/goDraw.html",
+			"testdata/readdir/1.txt",
+			"testdata/readdir/2.txt",
+		}, matches)
+
+		matches, err = br.Glob("testdata/missing/*")
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		sub, err := br.Sub("testdata/js")
+		assert.NoError(t, err)
+		matches, err = sub.Glob("**/*.js")
+		assert.NoError(t, err)
+		assert.Len(t, matches, 3)
+		assert.Equal(t, "googleJS.js", matches[0])
+		matches, err = sub.Glob("../*.html")
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		for _, pattern := range []string{"testdata/[", "testdata/{a,b", "{[}"} {
+			_, err = br.Glob(pattern)
+			assert.Equal(t, path.ErrBadPattern, err, pattern)
+		}
+	}
+
+	br := bundleWith(t, nil)
+	assert.NoError(t, br.WriteFile("testdata/js/config.js", []byte("cfg")))
+	assert.NoError(t, br.Remove("testdata/js/googleJS.js"))
+	matches, err := br.Glob("testdata/js/*.js")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testdata/js/config.js"}, matches)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	br := bundleWith(t, map[string]string{"testdata/Logo.PNG": "png"})
+	_, err := br.Open("testdata/logo.png")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	br.CaseInsensitive(true)
+	for _, name := range []string{"testdata/logo.png", "TESTDATA/Logo.png", "testdata/Logo.PNG"} {
+		f, err := openFile(br, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "testdata/Logo.PNG", f.Fpath)
+	}
+
+	var paths []string
+	br.Walk("TestData/JS/YoutubeScript", func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return nil
+	})
+	assert.Len(t, paths, 4)
+
+	sub, err := br.Sub("TESTDATA/Readdir")
+	assert.NoError(t, err)
+	_, err = sub.Stat("1.TXT")
+	assert.NoError(t, err)
+
+	assert.NoError(t, br.WriteFile("TestData/Config.js", []byte("cfg")))
+	assert.NoError(t, br.WriteFile("testdata/config.JS", []byte("cfg2")))
+	matches, err := br.Glob("testdata/*.js")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testdata/Config.js"}, matches)
+	assert.NoError(t, br.Remove("TESTDATA/LOGO.png"))
+	_, err = br.Stat("testdata/Logo.PNG")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	g := defaultOptions()
+	g.CaseInsensitive = true
+	bundle, err := gen.Bundle(context.Background(), g)
+	assert.NoError(t, err)
+	_, err = fs.New(false, bundle).Stat("TESTDATA/INDEX.HTML")
+	assert.NoError(t, err)
+
+	// the patches keep the mode
+	pack := func(data string) []byte {
+		files := []*fs.File{{Fpath: "logo.png", Fname: "logo.png", Data: []byte(data)}}
+		b, err := fs.PackWith(files, fs.PackOptions{Quality: 1, CaseInsensitive: true})
+		assert.NoError(t, err)
+		return b
+	}
+	old := pack("png")
+	patch, err := fs.Diff(old, pack("png2"), 1)
+	assert.NoError(t, err)
+	patched, err := fs.Patch(old, patch)
+	assert.NoError(t, err)
+	_, err = fs.New(false, patched).Stat("LOGO.png")
+	assert.NoError(t, err)
+
+	// the servers match the paths regardless of case, too
+	br = bundleWith(t, map[string]string{
+		"testdata/_headers":   "/js/*\n  Cache-Control: no-store\n",
+		"testdata/_redirects": "/old.html /index.html 301\n",
+	})
+	br.CaseInsensitive(true)
+	srv := br.ServeSPA("testdata", "index.html", fs.FallbackExclude("/api"), fs.AssetDirs("/js"))
+	for _, name := range []string{"/_HEADERS", "/_Redirects"} {
+		assert.Equal(t, http.StatusNotFound, serve(srv, name).Code, name)
+	}
+	w := serve(srv, "/JS/googleJS.js")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	w = serve(srv, "/OLD.html")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	for _, name := range []string{"/API/users", "/Js/missing"} {
+		req := httptest.NewRequest("GET", name, nil)
+		req.Header.Set("Accept", "text/html")
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, name)
+	}
+
+	files := []*fs.File{
+		{Fpath: "Public", Fname: "Public", Ftime: -1},
+		{Fpath: "public", Fname: "public", Ftime: -1},
+		{Fpath: "public/logo.png", Fname: "logo.png", Data: []byte("png")},
+	}
+	_, err = fs.PackWith(files, fs.PackOptions{Quality: 1, CaseInsensitive: true})
+	assert.EqualError(t, err, "paths differ only in case: Public and public")
+
+	files = []*fs.File{
+		{Fpath: "Public/Logo.png", Fname: "Logo.png", Data: []byte("png")},
+		{Fpath: "public/logo.png", Fname: "logo.png", Data: []byte("png")},
+	}
+	_, err = fs.PackWith(files, fs.PackOptions{Quality: 1, CaseInsensitive: true})
+	assert.EqualError(t, err, "paths differ only in case: Public and public, Public/Logo.png and public/logo.png")
+}
+
+func TestFromMap(t *testing.T) {
+	br, err := fs.FromMap(map[string][]byte{
+		"public/index.html":  []byte("<h1>Hello</h1>"),
+		"/public/js/app.js":  []byte("app()"),
+		`public\css\app.css`: []byte("body{}"),
+	})
+	assert.NoError(t, err)
+
+	f, err := openFile(br, "public/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "<h1>Hello</h1>", string(f.Data))
+
+	for _, name := range []string{"public/js/app.js", "public/css/app.css"} {
+		_, err = br.Stat(name)
+		assert.NoError(t, err, name)
+	}
+	info, err := br.Stat("public/js")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	_, err = fs.FromMap(map[string][]byte{"../secret": nil})
+	assert.True(t, errors.Is(err, os.ErrInvalid))
+	_, err = fs.FromMap(map[string][]byte{"a": nil, "/a": nil})
+	assert.Error(t, err)
+	_, err = fs.FromMap(map[string][]byte{"a": nil, "a/b": nil})
+	assert.Error(t, err)
+}
+
+type testLogger []string
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestGenOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broccoli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var logger testLogger
+	g := defaultOptions()
+	g.Quality = 1
+	g.Output = filepath.Join(dir, "assets.gen.go")
+	g.Variable = "assets"
+	g.BuildTags = "linux"
+	g.Exclude = "*.js"
+	g.Logger = &logger
+	code, err := gen.Generate(context.Background(), g)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(code), "// +build linux\n\n// Code generated by broccoli"))
+	assert.Contains(t, string(code), "\npackage main\n")
+	assert.Contains(t, string(code), "var assets = fs.New(false, ")
+	written, err := ioutil.ReadFile(g.Output)
+	assert.NoError(t, err)
+	assert.Equal(t, code, written)
+	assert.Contains(t, logger, "ignoring testdata/js/googleJS.js")
+
+	for option, g := range map[string]gen.Options{
+		"Include":  {Include: "*.html", Exclude: "*.js"},
+		"Quality":  {Quality: 12},
+		"Variable": {Variable: "1br"},
+		"Async":    {Async: true, Defer: true},
+		"Eager":    {Eager: "[html"},
+		"SRI":      {SRI: "md5"},
+	} {
+		_, err := gen.Bundle(context.Background(), g)
+		var optErr *gen.OptionError
+		if assert.True(t, errors.As(err, &optErr), option) {
+			assert.Equal(t, option, optErr.Option)
+		}
+	}
+
+	g = defaultOptions()
+	g.Inputs = []string{"testdata", "missing"}
+	_, err = gen.Bundle(context.Background(), g)
+	var inputErr *gen.InputError
+	assert.True(t, errors.As(err, &inputErr))
+	assert.Equal(t, "missing", inputErr.Path)
+	assert.True(t, os.IsNotExist(inputErr.Err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = gen.Bundle(ctx, defaultOptions())
+	assert.Equal(t, context.Canceled, err)
+}